@@ -0,0 +1,265 @@
+package proj2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ****************************************** APPEND LOG ********************************* //
+
+// AppendFile does not re-post a file's Metadata. It posts its Text block and
+// a small signed AppendRecord into the next free slot of the file's append
+// log, a sequence of records at UUIDs derived from Metadata.AppendLog. Only
+// users who can read Metadata know where the log is, and every re-key moves
+// it to a new random ID. Slots are only ever created, never overwritten, so
+// concurrent appenders each claim their own slot with a compare-and-set.
+// Whoever reads Metadata follows the log from AppendsFolded and merges the
+// records it finds, skipping any that do not verify, and whoever posts
+// Metadata thereby folds them in. Appenders never post Metadata just to
+// fold, so the log is only folded by writes such as StoreFile and
+// CompactFile that post it anyway.
+
+// Stored in a log slot by RevokeFile and SetCompression. An appender that
+// reaches it read Metadata from before the file was re-keyed or re-encoded,
+// or while it is being so, and has to start over. A revocation or codec
+// change that is abandoned moves Metadata past its seal.
+var appendLogSeal = []byte("SEALED")
+
+// The structure definition for a record in a file's append log
+type AppendRecord struct {
+	MetadataUUID uuid.UUID
+	Index        int
+	Appender     string
+	TextUUID     uuid.UUID
+	Length       int
+	ModTime      int64
+}
+
+// Returns a record of usr appending the block textUUID of length bytes to
+// the file described by metadata, stamped with the current time
+func newAppendRecord(usr User, metadata Metadata, textUUID uuid.UUID, length int) AppendRecord {
+	return AppendRecord{
+		MetadataUUID: metadata.MetadataUUID,
+		Appender:     usr.Username,
+		TextUUID:     textUUID,
+		Length:       length,
+		ModTime:      time.Now().UnixNano(),
+	}
+}
+
+// Returns the ID of the current append log of the file described by
+// metadata. Files posted before logs had their own ID use the MetadataUUID.
+func appendLogID(metadata Metadata) uuid.UUID {
+	if metadata.AppendLog == uuid.Nil {
+		return metadata.MetadataUUID
+	}
+	return metadata.AppendLog
+}
+
+// Returns the UUID of slot index of the append log logID
+func appendSlot(logID uuid.UUID, index int) (slot uuid.UUID) {
+	var hash = userlib.Hash([]byte(logID.String() + "-append-" + strconv.Itoa(index)))
+	copy(slot[:], hash[:16])
+	return slot
+}
+
+// Retrieves, decrypts and verifies the record in slot index of the append
+// log of the file described by metadata. present is false if the slot is
+// empty; sealed is true if it holds a seal rather than a record.
+func getAppendRecord(usr User, metadata Metadata, metadataKey []byte, index int) (record AppendRecord, present bool, sealed bool, err error) {
+	// variable declarations
+	var appenderDSPub userlib.DSVerifyKey
+	var ok bool
+	var plaintext, ciphertext, sig, val []byte
+
+	// retrieve from datastore and split val into components
+	val, ok = usr.backend.Datastore.Get(appendSlot(appendLogID(metadata), index))
+	if !ok {
+		return record, false, false, nil
+	}
+	if bytes.Equal(val, appendLogSeal) {
+		return record, true, true, nil
+	}
+	if len(val) < userlib.RSAKeySize/8 {
+		userlib.DebugMsg("append record was corrupted in datastore (not enough info)")
+		return record, true, false, errors.New(strings.ToTitle("append record was corrupted in datastore (not enough info)"))
+	}
+	sig = val[:userlib.RSAKeySize/8]
+	ciphertext = val[userlib.RSAKeySize/8:]
+
+	// decrypt, then verify against the appender named inside, as for Metadata
+	if len(ciphertext)%userlib.AESBlockSize != 0 || len(ciphertext) < 2*userlib.AESBlockSize {
+		userlib.DebugMsg("ciphertext is not a multiple of the block size!")
+		return record, true, false, errors.New(strings.ToTitle("ciphertext is not a multiple of the block size!"))
+	}
+	plaintext = userlib.SymDec(metadataKey, ciphertext)
+	plaintext = unpad(plaintext)
+	err = json.Unmarshal(plaintext, &record)
+	if err != nil {
+		userlib.DebugMsg("error unmarshalling append record")
+		return record, true, false, err
+	}
+	appenderDSPub, ok = usr.backend.Keystore.Get(record.Appender + "-DSVerifyKey")
+	if !ok {
+		userlib.DebugMsg(record.Appender + " does not have a posted DS Verify Key!")
+		return record, true, false, errors.New(strings.ToTitle("cannot find appender's DS Verify key!"))
+	}
+	err = userlib.DSVerify(appenderDSPub, ciphertext, sig)
+	if err != nil {
+		userlib.DebugMsg("signature on append record did not match; data has been corrupted")
+		return record, true, false, err
+	}
+	if record.MetadataUUID != metadata.MetadataUUID || record.Index != index {
+		userlib.DebugMsg("append record was moved from another slot!")
+		return record, true, false, errors.New(strings.ToTitle("append record was moved from another slot!"))
+	}
+	if !accessContains(metadata.AccessMap, record.Appender) {
+		userlib.DebugMsg(record.Appender + " appended without access to the file")
+		return record, true, false, errors.New(strings.ToTitle("append record was signed by a user without access"))
+	}
+	return record, true, false, nil
+}
+
+// Merges every record in the append log past metadata.AppendsFolded into
+// metadata, stopping at the first empty or sealed slot. A slot holding
+// anything that does not verify is skipped as a hole, so that no one
+// writing to the datastore can make the file unreadable. Returns the Text
+// blocks the records added.
+func followAppends(usr User, metadata *Metadata, metadataKey []byte) (added []uuid.UUID, err error) {
+	var record AppendRecord
+	var present, sealed bool
+
+	for {
+		record, present, sealed, err = getAppendRecord(usr, *metadata, metadataKey, metadata.AppendsFolded)
+		if err != nil {
+			userlib.DebugMsg("skipping unverifiable append record " + strconv.Itoa(metadata.AppendsFolded))
+			metadata.AppendsFolded++
+			continue
+		}
+		if !present || sealed {
+			return added, nil
+		}
+		appendBlock(metadata, record.TextUUID, record.Length)
+		metadata.LastModified = record.Appender
+		metadata.ModTime = record.ModTime
+		metadata.AppendsFolded++
+		added = append(added, record.TextUUID)
+	}
+}
+
+// Posts record into the first free slot of the append log at or past
+// metadata.AppendsFolded and returns the slot's index. Returns
+// errMetadataConflict if the log has been sealed since metadata was read.
+func postAppendRecord(usr User, metadata Metadata, metadataKey []byte, record AppendRecord) (index int, err error) {
+	var slot uuid.UUID
+	var val []byte
+	var ok, swapped bool
+
+	index = metadata.AppendsFolded
+	for {
+		slot = appendSlot(appendLogID(metadata), index)
+		val, ok = usr.backend.Datastore.Get(slot)
+		if ok {
+			if bytes.Equal(val, appendLogSeal) {
+				userlib.DebugMsg("append log was sealed; file was re-keyed since it was read")
+				return index, errMetadataConflict
+			}
+			index++
+			continue
+		}
+		record.Index = index
+		val, err = sealStruct(record, metadataKey, nil, nil, usr, true)
+		if err != nil {
+			userlib.DebugMsg("error sealing append record")
+			return index, err
+		}
+		swapped, err = compareAndSwap(usr.backend.Datastore, slot, nil, val)
+		if err != nil {
+			userlib.DebugMsg("error posting append record")
+			return index, err
+		}
+		if swapped {
+			return index, nil
+		}
+		// another appender claimed the slot first; look at what it holds
+	}
+}
+
+// Seals the append log after the last record metadata reflects, so that
+// appenders holding metadata's keys can no longer add to the file. Records
+// that land before the seal are merged into metadata first. A seal left by
+// an earlier, interrupted attempt is reused.
+func sealAppendLog(usr User, metadata *Metadata, metadataKey []byte) (err error) {
+	var slot uuid.UUID
+	var val []byte
+	var ok, swapped bool
+
+	for {
+		slot = appendSlot(appendLogID(*metadata), metadata.AppendsFolded)
+		swapped, err = compareAndSwap(usr.backend.Datastore, slot, nil, appendLogSeal)
+		if err != nil {
+			userlib.DebugMsg("error posting append log seal")
+			return err
+		}
+		if !swapped {
+			val, ok = usr.backend.Datastore.Get(slot)
+			swapped = ok && bytes.Equal(val, appendLogSeal)
+		}
+		if swapped {
+			metadata.AppendsFolded++
+			return nil
+		}
+		_, err = followAppends(usr, metadata, metadataKey)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Moves metadata past a seal at the end of its append log, left by a
+// revocation that is being undone, so that appenders can use the log again.
+// Reports whether there was a seal.
+func unsealAppendLog(usr User, metadata *Metadata) (sealed bool) {
+	var val []byte
+	var ok bool
+
+	val, ok = usr.backend.Datastore.Get(appendSlot(appendLogID(*metadata), metadata.AppendsFolded))
+	if !ok || !bytes.Equal(val, appendLogSeal) {
+		return false
+	}
+	metadata.AppendsFolded++
+	return true
+}
+
+// Returns the IDs of every append log of the file described by metadata:
+// the current one and those sealed by earlier re-keys
+func appendLogIDs(metadata Metadata) (logIDs []uuid.UUID) {
+	logIDs = append(logIDs, metadata.RetiredAppendLogs...)
+	return append(logIDs, appendLogID(metadata))
+}
+
+// Deletes every slot of the append log logID. Slots are never deleted
+// singly, so the log ends at the first empty one.
+func deleteAppendLog(usr User, logID uuid.UUID) (err error) {
+	var slot uuid.UUID
+	var ok bool
+
+	for i := 0; ; i++ {
+		slot = appendSlot(logID, i)
+		if _, ok = usr.backend.Datastore.Get(slot); !ok {
+			return nil
+		}
+		err = usr.backend.Datastore.Delete(slot)
+		if err != nil {
+			userlib.DebugMsg("error deleting append record")
+			return err
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package proj2
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestAppendLog(t *testing.T) {
+	store := NewMemoryDatastore()
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	bob, _ := InitUserWithBackend(backend, "bob", "bar")
+	alice.StoreFile("file1", []byte("start;"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+
+	filenameHash := getFilenameHash("file1", "alice")
+	before, _, _, _ := verifyFileAccessHelper(*alice, filenameHash)
+	expected := []byte("start;")
+	for i := 0; i < 3; i++ {
+		bob.AppendFile("shared", []byte("bob;"))
+		expected = append(expected, []byte("bob;")...)
+	}
+
+	// appends leave the stored metadata alone but are seen by every reader
+	stored, _, _, _ := verifyFileAccessHelper(*alice, filenameHash)
+	if stored.Revision != before.Revision || len(stored.TextList) != 1 {
+		t.Error("Append re-posted file metadata", stored.Revision, len(stored.TextList))
+		return
+	}
+	if !checkContents(t, alice, "file1", expected) {
+		return
+	}
+	info, _ := alice.StatFile("file1")
+	if info.Size != int64(len(expected)) || info.Blocks != 4 || info.LastModifiedBy != "bob" {
+		t.Error("StatFile did not reflect pending appends", info)
+		return
+	}
+	buf := make([]byte, 4)
+	if n, err := alice.ReadAt("file1", buf, int64(len(expected)-4)); n != 4 || err != nil || string(buf) != "bob;" {
+		t.Error("ReadAt did not reflect pending appends", n, err, string(buf))
+		return
+	}
+
+	// streamed appends go through the log too
+	w, _ := bob.OpenAppender("shared")
+	w.Write([]byte("stream;"))
+	w.Close()
+	expected = append(expected, []byte("stream;")...)
+	stored, _, _, _ = verifyFileAccessHelper(*alice, filenameHash)
+	if stored.Revision != before.Revision {
+		t.Error("Streamed append re-posted file metadata")
+		return
+	}
+
+	// a write that posts metadata folds the log into it
+	if err := alice.CompactFile("file1", 0); err != nil {
+		t.Error("Failed to compact", err)
+		return
+	}
+	stored, _, _, _ = verifyFileAccessHelper(*alice, filenameHash)
+	if stored.AppendsFolded != 4 || stored.Revision == before.Revision {
+		t.Error("Append log was not folded into metadata", stored.AppendsFolded)
+		return
+	}
+	checkContents(t, bob, "shared", expected)
+}
+
+func TestAppendLogRevoke(t *testing.T) {
+	store := NewMemoryDatastore()
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	bob, _ := InitUserWithBackend(backend, "bob", "bar")
+	alice.StoreFile("file1", []byte("start;"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+	bob.AppendFile("shared", []byte("bob;"))
+
+	// records bob made before losing access are kept and re-keyed
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if err := alice.RevokeFile("file1", "bob"); err != nil {
+		t.Error("Failed to revoke", err)
+		return
+	}
+	if !checkContents(t, alice, "file1", []byte("start;bob;")) {
+		return
+	}
+	val, _ := store.Get(appendSlot(appendLogID(metadata), 1))
+	if !bytes.Equal(val, appendLogSeal) {
+		t.Error("Revoke did not seal the append log")
+		return
+	}
+	if err := bob.AppendFile("shared", []byte("late;")); err == nil {
+		t.Error("Revoked user appended to the file")
+		return
+	}
+	rekeyed, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if appendLogID(rekeyed) == appendLogID(metadata) {
+		t.Error("Revoke did not move the append log")
+		return
+	}
+
+	// bob only knows where the old log is, and junk planted in the new one
+	// by anyone who finds it is skipped
+	store.Set(appendSlot(appendLogID(metadata), 2), []byte("junk"))
+	store.Set(appendSlot(appendLogID(rekeyed), 0), bytes.Repeat([]byte("junk"), 100))
+	if !checkContents(t, alice, "file1", []byte("start;bob;")) {
+		return
+	}
+	if err := alice.AppendFile("file1", []byte("alice;")); err != nil {
+		t.Error("Failed to append past a planted record", err)
+		return
+	}
+	if !checkContents(t, alice, "file1", []byte("start;bob;alice;")) {
+		return
+	}
+
+	// deleting the file removes both append logs
+	alice.DeleteFile("file1")
+	for _, logID := range []uuid.UUID{appendLogID(metadata), appendLogID(rekeyed)} {
+		if _, ok := store.Get(appendSlot(logID, 0)); ok {
+			t.Error("DeleteFile left an append log behind")
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package proj2
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ************************************* CONCURRENT UPDATES ****************************** //
+
+// How many times a writer re-reads and re-applies its change after losing a
+// compare-and-set race before giving up
+const casRetries = 32
+
+// Returned by postMetadataCAS when another writer updated the record first
+var errMetadataConflict = errors.New(strings.ToTitle("file metadata was changed concurrently"))
+
+// Posts metadata only if its record in the datastore is still old, the raw
+// record verifyFileAccessRaw returned. Bumps metadata's signed Revision.
+// Returns errMetadataConflict if another writer posted in the meantime.
+func postMetadataCAS(usr User, metadata *Metadata, metadataKey []byte, old []byte) (err error) {
+	var val []byte
+	var swapped bool
+
+	metadata.Revision++
+	val, err = sealStruct(*metadata, metadataKey, nil, nil, usr, true)
+	if err != nil {
+		userlib.DebugMsg("error when sealing metadata struct for file")
+		return err
+	}
+	swapped, err = compareAndSwap(usr.backend.Datastore, metadata.MetadataUUID, old, val)
+	if err != nil {
+		userlib.DebugMsg("error when posting metadata struct for file")
+		return err
+	}
+	if !swapped {
+		userlib.DebugMsg("file metadata changed since it was read")
+		return errMetadataConflict
+	}
+	return nil
+}
+
+// Runs op, which should read metadata with verifyFileAccessRaw and post it
+// with postMetadataCAS, until it does not fail with errMetadataConflict
+func retryOnConflict(op func() error) (err error) {
+	for i := 0; i < casRetries; i++ {
+		err = op()
+		if err != errMetadataConflict {
+			return err
+		}
+	}
+	return err
+}
+
+// Applies update to the current metadata of the file under filenameHash and
+// posts the result with compare-and-set. If another writer got there first,
+// the metadata is read again and update re-applied, so concurrent updates
+// are never lost. update must not have side effects beyond metadata.
+// Returns the metadata as posted.
+func updateMetadata(usr User, filenameHash string, update func(metadata *Metadata) error) (metadata Metadata, metadataKey []byte, err error) {
+	var raw []byte
+
+	err = retryOnConflict(func() (err error) {
+		metadata, metadataKey, raw, err = verifyFileAccessRaw(usr, filenameHash)
+		if err != nil {
+			return err
+		}
+		err = update(&metadata)
+		if err != nil {
+			return err
+		}
+		return postMetadataCAS(usr, &metadata, metadataKey, raw)
+	})
+	return metadata, metadataKey, err
+}
+
+// Applies update to the Sentinel at sentinelUUID and posts it with
+// compare-and-set, re-reading and re-applying on conflict
+func updateSentinel(usr User, sentinelUUID uuid.UUID, update func(sentinel *Sentinel) error) (err error) {
+	var sentinel Sentinel
+	var raw, val []byte
+	var ok, swapped bool
+
+	for i := 0; i < casRetries; i++ {
+		raw, ok = usr.backend.Datastore.Get(sentinelUUID)
+		if !ok {
+			userlib.DebugMsg("file sentinel is not at recorded UUID")
+			return errors.New(strings.ToTitle("file sentinel is not at recorded UUID"))
+		}
+		sentinel = Sentinel{}
+		err = json.Unmarshal(raw, &sentinel)
+		if err != nil {
+			userlib.DebugMsg("error unmarshalling file sentinel")
+			return err
+		}
+		err = update(&sentinel)
+		if err != nil {
+			return err
+		}
+		val, err = json.Marshal(sentinel)
+		if err != nil {
+			userlib.DebugMsg("error marshalling file sentinel")
+			return err
+		}
+		swapped, err = compareAndSwap(usr.backend.Datastore, sentinelUUID, raw, val)
+		if err != nil || swapped {
+			return err
+		}
+	}
+	userlib.DebugMsg("file sentinel kept changing; giving up")
+	return errors.New(strings.ToTitle("file sentinel was changed concurrently"))
+}
+
+// Returned by namespace updates when the name they would add is taken
+var errFileExists = errors.New(strings.ToTitle("There is already a file with this name!"))
+
+// Applies update to the current User struct of usr's user and posts the
+// result with compare-and-set. If another session of the same user posted
+// first, the struct is read again and update re-applied, so changes made by
+// concurrent sessions are merged rather than overwritten. update should
+// only change the entries it means to add or remove. On success *usr is
+// the User struct as posted.
+func updateUser(usr *User, update func(usr *User) error) (err error) {
+	var fresh *User
+	var usrUUID uuid.UUID
+	var raw, val []byte
+	var swapped bool
+
+	for i := 0; i < casRetries; i++ {
+		fresh, raw, err = getUserRaw(usr.backend, usr.Username, usr.password, usr.session)
+		if err != nil {
+			userlib.DebugMsg("Could not update User struct!")
+			return err
+		}
+		err = update(fresh)
+		if err != nil {
+			return err
+		}
+		usrUUID, val, err = sealUser(*fresh, usr.Username, usr.password)
+		if err != nil {
+			return err
+		}
+		swapped, err = compareAndSwap(usr.backend.Datastore, usrUUID, raw, val)
+		if err != nil {
+			userlib.DebugMsg("error when posting user struct of " + usr.Username)
+			return err
+		}
+		if swapped {
+			*usr = *fresh
+			return nil
+		}
+	}
+	userlib.DebugMsg("user struct kept changing; giving up")
+	return errors.New(strings.ToTitle("user struct was changed concurrently"))
+}
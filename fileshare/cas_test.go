@@ -0,0 +1,207 @@
+package proj2
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCompareAndSwap(t *testing.T) {
+	ts, _, backend := remoteTestServer()
+	defer ts.Close()
+	dir, err := NewDirDatastore(t.TempDir(), SyncNone)
+	if err != nil {
+		t.Error("Failed to create directory datastore", err)
+		return
+	}
+	stores := map[string]Datastore{"memory": NewMemoryDatastore(), "dir": dir, "remote": backend.Datastore}
+
+	for name, store := range stores {
+		k := uuid.New()
+		if ok, err := compareAndSwap(store, k, nil, []byte("v1")); !ok || err != nil {
+			t.Error(name, "failed to create record with compare-and-swap", err)
+			return
+		}
+		if ok, _ := compareAndSwap(store, k, nil, []byte("v2")); ok {
+			t.Error(name, "created a record that already exists")
+			return
+		}
+		if ok, _ := compareAndSwap(store, k, []byte("stale"), []byte("v2")); ok {
+			t.Error(name, "swapped a record that does not hold the old value")
+			return
+		}
+		if ok, err := compareAndSwap(store, k, []byte("v1"), []byte("v2")); !ok || err != nil {
+			t.Error(name, "failed to swap a record holding the old value", err)
+			return
+		}
+		if v, _ := store.Get(k); string(v) != "v2" {
+			t.Error(name, "swap stored the wrong value", string(v))
+			return
+		}
+	}
+}
+
+func TestConcurrentAppends(t *testing.T) {
+	backend := Backend{Datastore: NewMemoryDatastore(), Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	bob, _ := InitUserWithBackend(backend, "bob", "bar")
+	alice.StoreFile("file1", []byte("start;"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+	alice2, _ := GetUserWithBackend(backend, "alice", "foo")
+
+	var wg sync.WaitGroup
+	appenders := []struct {
+		usr      *User
+		filename string
+		tag      string
+	}{{alice, "file1", "a"}, {alice2, "file1", "b"}, {bob, "shared", "c"}}
+	for _, a := range appenders {
+		wg.Add(1)
+		go func(usr *User, filename string, tag string) {
+			defer wg.Done()
+			for i := 0; i < 5; i++ {
+				if err := usr.AppendFile(filename, []byte(tag+";")); err != nil {
+					t.Error("Concurrent append failed", err)
+				}
+			}
+		}(a.usr, a.filename, a.tag)
+	}
+	wg.Wait()
+
+	data, err := alice.LoadFile("file1")
+	if err != nil {
+		t.Error("Failed to load file after concurrent appends", err)
+		return
+	}
+	for _, tag := range []string{"a", "b", "c"} {
+		if strings.Count(string(data), tag+";") != 5 {
+			t.Error("Lost appends from", tag, string(data))
+			return
+		}
+	}
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if len(metadata.TextList) != 16 || metadata.AppendsFolded != 15 {
+		t.Error("Metadata did not reflect every append", len(metadata.TextList), metadata.AppendsFolded)
+		return
+	}
+}
+
+func TestConcurrentShares(t *testing.T) {
+	backend := Backend{Datastore: NewMemoryDatastore(), Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	recipients := []string{"bob", "carol", "dave", "eve"}
+	users := make(map[string]*User)
+	for _, name := range recipients {
+		users[name], _ = InitUserWithBackend(backend, name, "pw")
+	}
+	alice.StoreFile("file1", []byte("shared contents"))
+
+	var wg sync.WaitGroup
+	magics := make(map[string]string)
+	var mu sync.Mutex
+	for _, name := range recipients {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			session, _ := GetUserWithBackend(backend, "alice", "foo")
+			magic, err := session.ShareFile("file1", name)
+			if err != nil {
+				t.Error("Concurrent share failed", err)
+				return
+			}
+			mu.Lock()
+			magics[name] = magic
+			mu.Unlock()
+		}(name)
+	}
+	wg.Wait()
+
+	for _, name := range recipients {
+		if err := users[name].ReceiveFile("file1", "alice", magics[name]); err != nil {
+			t.Error("Failed to receive concurrently shared file", name, err)
+			return
+		}
+		checkContents(t, users[name], "file1", []byte("shared contents"))
+	}
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if len(metadata.AccessMap["alice"]) != len(recipients) {
+		t.Error("Concurrent shares were lost from the access map", metadata.AccessMap)
+		return
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	backend := Backend{Datastore: NewMemoryDatastore(), Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	bob, _ := InitUserWithBackend(backend, "bob", "bar")
+	bob.StoreFile("bobfile", []byte("bob's contents"))
+	magic, _ := bob.ShareFile("bobfile", "alice")
+
+	// three devices change alice's namespace at once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			session, _ := GetUserWithBackend(backend, "alice", "foo")
+			for j := 0; j < 3; j++ {
+				name := "file" + string(rune('a'+i)) + string(rune('0'+j))
+				session.StoreFile(name, []byte(name))
+			}
+			switch i {
+			case 0:
+				if err := session.ReceiveFile("from bob", "bob", magic); err != nil {
+					t.Error("Concurrent receive failed", err)
+				}
+			case 1:
+				if err := session.Snapshot("snap"); err != nil {
+					t.Error("Concurrent snapshot failed", err)
+				}
+			case 2:
+				session.StoreFile("same name", []byte("written twice"))
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		session, _ := GetUserWithBackend(backend, "alice", "foo")
+		session.StoreFile("same name", []byte("written twice"))
+	}()
+	wg.Wait()
+
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	files, err := alice.ListFiles()
+	if err != nil {
+		t.Error("Failed to list files", err)
+		return
+	}
+	names := make(map[string]bool)
+	for _, f := range files {
+		names[f.Name] = true
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			name := "file" + string(rune('a'+i)) + string(rune('0'+j))
+			if !names[name] {
+				t.Error("Concurrent sessions lost a file from the namespace", name, names)
+				return
+			}
+			checkContents(t, alice, name, []byte(name))
+		}
+	}
+	checkContents(t, alice, "same name", []byte("written twice"))
+	if !names["from bob"] {
+		t.Error("Concurrent sessions lost a received file", names)
+		return
+	}
+	if snapshots, _ := alice.ListSnapshots(); len(snapshots) != 1 {
+		t.Error("Concurrent sessions lost a snapshot", snapshots)
+		return
+	}
+}
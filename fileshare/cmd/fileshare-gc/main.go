@@ -0,0 +1,141 @@
+// Command fileshare-gc finds, and optionally deletes, datastore records that
+// no live user can reach.
+//
+// Usage:
+//
+//	fileshare-gc [-server URL | -dir DIR] [-credentials FILE] [-roots FILE] [-delete]
+//
+// -credentials names a JSON object mapping every live username to its
+// password; those users' files are traced in full. -roots names a file of
+// User record UUIDs, one per line, for users whose password is not known;
+// their records are kept but cannot be traced, so -delete is refused when
+// any are given. -delete is also refused when some file in a traced
+// namespace cannot be read by any of the given users. Unreachable record
+// UUIDs are printed one per line.
+//
+// Run it while no clients are writing: a block that has been posted but
+// not yet linked into its file's Metadata looks unreachable.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/ultraviolex/Projects/fileshare"
+)
+
+func main() {
+	server := flag.String("server", "", "URL of a fileshare-server")
+	dir := flag.String("dir", "", "local directory the datastore and keystore are kept in")
+	credsFile := flag.String("credentials", "", "JSON file mapping usernames to passwords")
+	rootsFile := flag.String("roots", "", "file of User record UUIDs, one per line")
+	del := flag.Bool("delete", false, "delete unreachable records instead of only listing them")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := run(*server, *dir, *credsFile, *rootsFile, *del)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fileshare-gc:", err)
+		os.Exit(1)
+	}
+}
+
+// Runs one mark-and-sweep pass and prints the result
+func run(server string, dir string, credsFile string, rootsFile string, del bool) (err error) {
+	var backend proj2.Backend
+	var roots proj2.SweepRoots
+	var report proj2.SweepReport
+
+	backend, err = openBackend(server, dir)
+	if err != nil {
+		return err
+	}
+	if credsFile == "" && rootsFile == "" {
+		return errors.New("at least one of -credentials or -roots is required")
+	}
+	if credsFile != "" {
+		roots.Credentials, err = readCredentials(credsFile)
+		if err != nil {
+			return err
+		}
+	}
+	if rootsFile != "" {
+		roots.UserUUIDs, err = readRoots(rootsFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	report, err = proj2.MarkAndSweep(backend, roots, del)
+	for _, key := range report.Unreachable {
+		fmt.Println(key)
+	}
+	fmt.Fprintf(os.Stderr, "%d reachable, %d unreachable, %d deleted, %d files untraced\n",
+		report.Reachable, len(report.Unreachable), report.Deleted, len(report.Untraced))
+	return err
+}
+
+// Builds the backend selected by the -server and -dir flags
+func openBackend(server string, dir string) (backend proj2.Backend, err error) {
+	switch {
+	case server != "" && dir != "":
+		return backend, errors.New("-server and -dir are mutually exclusive")
+	case server != "":
+		return proj2.NewRemoteBackend(server, nil), nil
+	case dir != "":
+		backend.Datastore, err = proj2.NewDirDatastore(filepath.Join(dir, "datastore"), proj2.SyncAll)
+		if err != nil {
+			return backend, err
+		}
+		backend.Keystore, err = proj2.NewFileKeystore(filepath.Join(dir, "keystore.json"))
+		return backend, err
+	default:
+		return backend, errors.New("one of -server or -dir is required")
+	}
+}
+
+// Reads a JSON object of username -> password
+func readCredentials(path string) (creds map[string]string, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return creds, nil
+}
+
+// Reads UUIDs one per line, skipping blank lines and # comments
+func readRoots(path string) (roots []uuid.UUID, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		root, err := uuid.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		roots = append(roots, root)
+	}
+	return roots, scanner.Err()
+}
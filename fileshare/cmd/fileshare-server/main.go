@@ -0,0 +1,66 @@
+// Command fileshare-server serves a fileshare datastore and keystore over HTTP.
+//
+// Datastore records are encrypted and authenticated by clients, so the
+// server is not trusted with them. It does hand out the public keys clients
+// encrypt to and verify with, though, so it has to be trusted for the
+// keystore; run it somewhere its users trust. Run with no flags for a purely
+// in-memory server, or point -datastore and -keystore at disk locations for
+// one that survives restarts:
+//
+//	fileshare-server -addr :8080 -datastore /var/lib/fileshare/data -keystore /var/lib/fileshare/keys.json
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/ultraviolex/Projects/fileshare"
+)
+
+// Maps the -sync flag values to datastore sync policies
+var syncPolicies = map[string]proj2.SyncPolicy{
+	"none": proj2.SyncNone,
+	"data": proj2.SyncData,
+	"all":  proj2.SyncAll,
+}
+
+func main() {
+	var ds proj2.Datastore
+	var ks proj2.Keystore
+	var err error
+
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dataDir := flag.String("datastore", "", "directory to persist datastore records in (default: in memory)")
+	keyFile := flag.String("keystore", "", "file to persist keystore entries in (default: in memory)")
+	syncFlag := flag.String("sync", "all", "datastore fsync policy: none, data or all")
+	maxRecord := flag.Int64("max-record", proj2.DefaultMaxRecordSize, "largest datastore record to accept, in bytes")
+	flag.Parse()
+
+	policy, ok := syncPolicies[*syncFlag]
+	if !ok {
+		log.Fatalf("unknown -sync policy %q", *syncFlag)
+	}
+
+	if *dataDir == "" {
+		ds = proj2.NewMemoryDatastore()
+	} else {
+		ds, err = proj2.NewDirDatastore(*dataDir, policy)
+		if err != nil {
+			log.Fatalf("opening datastore: %v", err)
+		}
+	}
+	if *keyFile == "" {
+		ks = proj2.NewMemoryKeystore()
+	} else {
+		ks, err = proj2.NewFileKeystore(*keyFile)
+		if err != nil {
+			log.Fatalf("opening keystore: %v", err)
+		}
+	}
+
+	srv := proj2.NewServer(ds, ks)
+	srv.MaxRecordSize = *maxRecord
+	log.Printf("fileshare-server listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, srv))
+}
@@ -0,0 +1,222 @@
+// Command fileshare drives the fileshare User API from the shell.
+//
+// Usage:
+//
+//	fileshare [flags] init
+//	fileshare [flags] login
+//	fileshare [flags] put <name> [local-file]
+//	fileshare [flags] get <name> [local-file]
+//	fileshare [flags] append <name> [local-file]
+//	fileshare [flags] share <name> <recipient>
+//	fileshare [flags] receive <name> <sender> [magic-string]
+//	fileshare [flags] revoke <name> <target>
+//
+// A missing or "-" local file means stdin (put, append) or stdout (get); a
+// missing or "-" magic string is read from stdin. share prints the magic
+// string as unpadded base64url so it survives copy-pasting through a shell,
+// chat client or email.
+//
+// Exactly one of -server (a fileshare-server URL) or -dir (a local state
+// directory) selects where records are kept. The password is taken from
+// -password or, to keep it out of shell history, from $FILESHARE_PASSWORD.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ultraviolex/Projects/fileshare"
+)
+
+const usage = `usage: fileshare [flags] <command> [args]
+
+commands:
+  init                                 create the user
+  login                                check that the credentials are valid
+  put <name> [local-file]              store a file (default: stdin)
+  get <name> [local-file]              load a file (default: stdout)
+  append <name> [local-file]           append to a file (default: stdin)
+  share <name> <recipient>             print a magic string for recipient
+  receive <name> <sender> [magic]      accept a shared file (default: stdin)
+  revoke <name> <target>               revoke target's access
+
+flags:
+`
+
+func main() {
+	server := flag.String("server", "", "URL of a fileshare-server")
+	dir := flag.String("dir", "", "local directory to keep datastore and keystore in")
+	username := flag.String("user", os.Getenv("USER"), "username")
+	password := flag.String("password", "", "password (default $FILESHARE_PASSWORD)")
+	concurrency := flag.Int("concurrency", 0, "how many blocks to fetch at once (default 8)")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// read only now, so that -h never prints it as the default
+	if *password == "" {
+		*password = os.Getenv("FILESHARE_PASSWORD")
+	}
+
+	backend, err := openBackend(*server, *dir)
+	if err == nil {
+		backend.Concurrency = *concurrency
+		err = run(backend, *username, *password, flag.Arg(0), flag.Args()[1:])
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fileshare:", err)
+		os.Exit(1)
+	}
+}
+
+// Builds the backend selected by the -server and -dir flags
+func openBackend(server string, dir string) (backend proj2.Backend, err error) {
+	switch {
+	case server != "" && dir != "":
+		return backend, errors.New("-server and -dir are mutually exclusive")
+	case server != "":
+		return proj2.NewRemoteBackend(server, nil), nil
+	case dir != "":
+		backend.Datastore, err = proj2.NewDirDatastore(filepath.Join(dir, "datastore"), proj2.SyncAll)
+		if err != nil {
+			return backend, err
+		}
+		backend.Keystore, err = proj2.NewFileKeystore(filepath.Join(dir, "keystore.json"))
+		return backend, err
+	default:
+		return backend, errors.New("one of -server or -dir is required")
+	}
+}
+
+// Runs a single command
+func run(backend proj2.Backend, username string, password string, cmd string, args []string) (err error) {
+	var usr *proj2.User
+	var data []byte
+	var magic string
+
+	if cmd == "init" {
+		if err = wantArgs(args, 0, 0); err != nil {
+			return err
+		}
+		_, err = proj2.InitUserWithBackend(backend, username, password)
+		return err
+	}
+	usr, err = proj2.GetUserWithBackend(backend, username, password)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "login":
+		if err = wantArgs(args, 0, 0); err != nil {
+			return err
+		}
+		fmt.Println("logged in as", usr.Username)
+	case "put", "append":
+		if err = wantArgs(args, 1, 2); err != nil {
+			return err
+		}
+		data, err = readInput(optArg(args, 1))
+		if err != nil {
+			return err
+		}
+		if cmd == "put" {
+			// StoreFile reports no errors, so read the file back to tell
+			usr.StoreFile(args[0], data)
+			stored, err := usr.LoadFile(args[0])
+			if err != nil || !bytes.Equal(stored, data) {
+				return fmt.Errorf("could not store %q", args[0])
+			}
+			return nil
+		}
+		return usr.AppendFile(args[0], data)
+	case "get":
+		if err = wantArgs(args, 1, 2); err != nil {
+			return err
+		}
+		data, err = usr.LoadFile(args[0])
+		if err != nil {
+			return err
+		}
+		return writeOutput(optArg(args, 1), data)
+	case "share":
+		if err = wantArgs(args, 2, 2); err != nil {
+			return err
+		}
+		magic, err = usr.ShareFile(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(base64.RawURLEncoding.EncodeToString([]byte(magic)))
+	case "receive":
+		if err = wantArgs(args, 2, 3); err != nil {
+			return err
+		}
+		magic = optArg(args, 2)
+		if magic == "-" {
+			data, err = io.ReadAll(os.Stdin)
+			if err != nil {
+				return err
+			}
+			magic = string(data)
+		}
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimSpace(magic))
+		if err != nil {
+			return errors.New("magic string is not valid base64url")
+		}
+		return usr.ReceiveFile(args[0], args[1], string(data))
+	case "revoke":
+		if err = wantArgs(args, 2, 2); err != nil {
+			return err
+		}
+		return usr.RevokeFile(args[0], args[1])
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+// Checks that a command got between min and max arguments
+func wantArgs(args []string, min int, max int) error {
+	if len(args) < min || len(args) > max {
+		return errors.New("wrong number of arguments; run with -h for usage")
+	}
+	return nil
+}
+
+// Returns args[i], or "-" if it was not given
+func optArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return "-"
+}
+
+// Reads all of path, or stdin if path is "-"
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// Writes data to path, or stdout if path is "-"
+func writeOutput(path string, data []byte) error {
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/ultraviolex/Projects/fileshare"
+)
+
+// A datastore whose writes fail once broken is set
+type brokenDatastore struct {
+	proj2.Datastore
+	broken bool
+}
+
+func (store *brokenDatastore) Set(key uuid.UUID, value []byte) error {
+	if store.broken {
+		return errors.New("datastore is unavailable")
+	}
+	return store.Datastore.Set(key, value)
+}
+
+// Runs f with os.Stdout redirected to a pipe and returns what it printed
+func captureStdout(f func() error) (printed string, err error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	r.Close()
+	return string(out), err
+}
+
+func TestRun(t *testing.T) {
+	store := &brokenDatastore{Datastore: proj2.NewMemoryDatastore()}
+	backend := proj2.Backend{Datastore: store, Keystore: proj2.NewMemoryKeystore()}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	out := filepath.Join(dir, "out")
+	os.WriteFile(in, []byte("hello "), 0600)
+
+	if err := run(backend, "alice", "foo", "init", nil); err != nil {
+		t.Error("init failed", err)
+		return
+	}
+	if err := run(backend, "alice", "wrong", "get", []string{"notes", out}); err == nil {
+		t.Error("logged in with the wrong password")
+		return
+	}
+	if err := run(backend, "alice", "foo", "put", []string{"notes", in}); err != nil {
+		t.Error("put failed", err)
+		return
+	}
+	if err := run(backend, "alice", "foo", "append", []string{"notes", in}); err != nil {
+		t.Error("append failed", err)
+		return
+	}
+	if err := run(backend, "alice", "foo", "get", []string{"notes", out}); err != nil {
+		t.Error("get failed", err)
+		return
+	}
+	if data, _ := os.ReadFile(out); !bytes.Equal(data, []byte("hello hello ")) {
+		t.Errorf("get wrote %q", data)
+		return
+	}
+
+	// a store that never lands is reported
+	store.broken = true
+	if err := run(backend, "alice", "foo", "put", []string{"other", in}); err == nil {
+		t.Error("put reported success although nothing was stored")
+		return
+	}
+	store.broken = false
+
+	if err := run(backend, "alice", "foo", "get", []string{"missing", out}); err == nil {
+		t.Error("got a file that was never stored")
+		return
+	}
+	if err := run(backend, "alice", "foo", "put", nil); err == nil {
+		t.Error("put ran without a file name")
+		return
+	}
+	if err := run(backend, "alice", "foo", "frobnicate", nil); err == nil {
+		t.Error("ran an unknown command")
+		return
+	}
+}
+
+func TestRunShare(t *testing.T) {
+	backend := proj2.Backend{Datastore: proj2.NewMemoryDatastore(), Keystore: proj2.NewMemoryKeystore()}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	out := filepath.Join(dir, "out")
+	os.WriteFile(in, []byte("shared notes"), 0600)
+	run(backend, "alice", "foo", "init", nil)
+	run(backend, "bob", "bar", "init", nil)
+	run(backend, "alice", "foo", "put", []string{"notes", in})
+
+	// the magic string share prints is what receive takes
+	magic, err := captureStdout(func() error {
+		return run(backend, "alice", "foo", "share", []string{"notes", "bob"})
+	})
+	if err != nil || magic == "" {
+		t.Error("share failed", err)
+		return
+	}
+	if err = run(backend, "bob", "bar", "receive", []string{"from alice", "alice", magic}); err != nil {
+		t.Error("receive failed", err)
+		return
+	}
+	if err = run(backend, "bob", "bar", "get", []string{"from alice", out}); err != nil {
+		t.Error("get of received file failed", err)
+		return
+	}
+	if data, _ := os.ReadFile(out); !bytes.Equal(data, []byte("shared notes")) {
+		t.Errorf("get of received file wrote %q", data)
+		return
+	}
+
+	if err = run(backend, "alice", "foo", "revoke", []string{"notes", "bob"}); err != nil {
+		t.Error("revoke failed", err)
+		return
+	}
+	if err = run(backend, "bob", "bar", "get", []string{"from alice", out}); err == nil {
+		t.Error("revoked user could still get the file")
+		return
+	}
+	if err = run(backend, "alice", "foo", "get", []string{"notes", out}); err != nil {
+		t.Error("owner could not get the file after revoking", err)
+		return
+	}
+}
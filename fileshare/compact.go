@@ -0,0 +1,169 @@
+package proj2
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ****************************************** COMPACTION ********************************* //
+
+// Merges runs of consecutive small Text blocks into blocks of at most
+// targetBlockSize bytes (DefaultBlockSize if targetBlockSize is not
+// positive), so that loading the file takes fewer Datastore round trips.
+// Blocks that are already at least targetBlockSize are left alone. Metadata
+// is re-signed once with the shorter TextList, after which the superseded
+// blocks are deleted. The file contents and ModTime are unchanged.
+func (usr *User) CompactFile(filename string, targetBlockSize int) (err error) {
+	// variable declarations
+	var metadata Metadata
+	var text Text
+	var filenameHash string
+	var raw, metadataKey, merged []byte
+	var lengths, newLengths []int
+	var newList, posted, superseded []uuid.UUID
+	var runLen, j int
+
+	if targetBlockSize <= 0 {
+		targetBlockSize = DefaultBlockSize
+	}
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+
+	// start over on the current metadata if another writer changes the file first
+	return retryOnConflict(func() (err error) {
+		newList, newLengths, posted, superseded = nil, nil, nil, nil
+		metadata, metadataKey, raw, err = verifyFileAccessRaw(*usr, filenameHash)
+		if err != nil {
+			userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+			return errors.New(strings.ToTitle("could not verify that user has access to file"))
+		}
+		lengths, err = blockLengths(*usr, metadata)
+		if err != nil {
+			return err
+		}
+
+		// greedily group blocks [i, j) whose combined length fits the target
+		for i := 0; i < len(lengths); i = j {
+			runLen = lengths[i]
+			for j = i + 1; j < len(lengths) && runLen+lengths[j] <= targetBlockSize; j++ {
+				runLen += lengths[j]
+			}
+			if j-i == 1 {
+				newList = append(newList, metadata.TextList[i])
+				newLengths = append(newLengths, lengths[i])
+				continue
+			}
+
+			merged = make([]byte, 0, runLen)
+			for k := i; k < j; k++ {
+				text, err = getText(*usr, metadata, metadata.TextList[k])
+				if err == nil && len(text.Data) != lengths[k] {
+					userlib.DebugMsg("text block length does not match file metadata")
+					err = errors.New(strings.ToTitle("text block length does not match file metadata"))
+				}
+				if err != nil {
+					deleteText(*usr, posted)
+					return err
+				}
+				merged = append(merged, text.Data...)
+			}
+			text.TextUUID = uuid.New()
+			text.Data = merged
+			err = postText(*usr, text, metadata)
+			if err != nil {
+				deleteText(*usr, posted)
+				return err
+			}
+			posted = append(posted, text.TextUUID)
+			superseded = append(superseded, metadata.TextList[i:j]...)
+			newList = append(newList, text.TextUUID)
+			newLengths = append(newLengths, runLen)
+		}
+		if len(superseded) == 0 {
+			return nil
+		}
+
+		// swap in the compacted block list
+		metadata.TextList = newList
+		metadata.TextLengths = newLengths
+		metadata.LastModified = usr.Username
+		err = postMetadataCAS(*usr, &metadata, metadataKey, raw)
+		if err != nil {
+			userlib.DebugMsg("error posting file metadata")
+			deleteText(*usr, posted)
+			return err
+		}
+		return releaseText(*usr, metadata, superseded)
+	})
+}
+
+// Reports whether compacting the file described by metadata into blocks of
+// at most its CompactBlockSize would merge any blocks. Follows the append
+// log on a copy to see the blocks appended since metadata was posted. If
+// block lengths are not recorded it cannot tell, and reports true.
+func worthCompacting(usr User, metadata Metadata, metadataKey []byte) bool {
+	var blockSize = metadata.CompactBlockSize
+
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	if _, err := followAppends(usr, &metadata, metadataKey); err != nil {
+		return false
+	}
+	if len(metadata.TextLengths) != len(metadata.TextList) {
+		return true
+	}
+	// CompactFile merges something exactly when some two neighbours fit together
+	for i := 1; i < len(metadata.TextLengths); i++ {
+		if metadata.TextLengths[i-1]+metadata.TextLengths[i] <= blockSize {
+			return true
+		}
+	}
+	return false
+}
+
+// Turns on automatic compaction for a file: whenever an AppendFile leaves
+// the file with more than threshold Text blocks, some of which could be
+// merged, the file is compacted into blocks of at most blockSize bytes
+// (DefaultBlockSize if blockSize is not positive). A threshold of 0 turns
+// automatic compaction off. The setting lives in the file's Metadata, so it
+// applies to every user of the file.
+func (usr *User) SetAutoCompaction(filename string, threshold int, blockSize int) (err error) {
+	// variable declarations
+	var filenameHash string
+
+	if threshold < 0 {
+		return errors.New(strings.ToTitle("negative compaction threshold"))
+	}
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	_, _, err = updateMetadata(*usr, filenameHash, func(metadata *Metadata) error {
+		metadata.CompactThreshold = threshold
+		metadata.CompactBlockSize = blockSize
+		metadata.LastModified = usr.Username
+		return nil
+	})
+	if err == errMetadataConflict {
+		return err
+	}
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return errors.New(strings.ToTitle("could not verify that user has access to file"))
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package proj2
+
+import (
+	"testing"
+)
+
+func TestCompactFile(t *testing.T) {
+	store := NewMemoryDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	bob, _ := InitUserWithBackend(alice.backend, "bob", "bar")
+
+	expected := "0123456789"
+	alice.StoreFile("file1", []byte("0123456789"))
+	for _, b := range []string{"ab", "cd", "ef", "0123456789", "gh"} {
+		alice.AppendFile("file1", []byte(b))
+		expected += b
+	}
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+	keys, _ := store.List()
+	before := len(keys)
+
+	// blocks 1-3 merge, the full blocks and the lone trailing block stay put
+	if err := bob.CompactFile("shared", 10); err != nil {
+		t.Error("Recipient failed to compact file", err)
+		return
+	}
+	checkContents(t, alice, "file1", []byte(expected))
+	checkContents(t, bob, "shared", []byte(expected))
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if len(metadata.TextList) != 4 || len(metadata.TextLengths) != 4 || metadata.TextLengths[1] != 6 {
+		t.Error("File was not compacted as expected", metadata.TextLengths)
+		return
+	}
+	keys, _ = store.List()
+	if len(keys) != before-2 {
+		t.Error("Superseded blocks were not deleted", before, len(keys))
+		return
+	}
+
+	// compacting again with the same target changes nothing
+	if err := alice.CompactFile("file1", 10); err != nil {
+		t.Error("Failed to compact an already compacted file", err)
+		return
+	}
+	again, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if len(again.TextList) != 4 || again.TextList[1] != metadata.TextList[1] {
+		t.Error("Compacting a compacted file rewrote blocks")
+		return
+	}
+
+	if err := alice.CompactFile("nonexistent", 10); err == nil {
+		t.Error("Compacted a file that does not exist")
+		return
+	}
+}
+
+func TestAutoCompaction(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	alice.StoreFile("log", []byte("start\n"))
+	if err := alice.SetAutoCompaction("log", 4, 0); err != nil {
+		t.Error("Failed to turn on automatic compaction", err)
+		return
+	}
+
+	expected := "start\n"
+	for i := 0; i < 10; i++ {
+		alice.AppendFile("log", []byte("line\n"))
+		expected += "line\n"
+
+		alice, _ = GetUser("alice", "foo")
+		metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("log", "alice"))
+		if len(metadata.TextList) > 4 {
+			t.Error("AppendFile let the file grow past the compaction threshold", len(metadata.TextList))
+			return
+		}
+	}
+	checkContents(t, alice, "log", []byte(expected))
+
+	// turning it off lets the block list grow again
+	alice.SetAutoCompaction("log", 0, 0)
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("log", "alice"))
+	before := len(metadata.TextList)
+	for i := 0; i < 5; i++ {
+		alice.AppendFile("log", []byte("line\n"))
+	}
+	metadata, _, _ = verifyFileAccess(*alice, getFilenameHash("log", "alice"))
+	if len(metadata.TextList) != before+5 {
+		t.Error("Automatic compaction still ran after being turned off", len(metadata.TextList))
+		return
+	}
+}
+
+func TestAutoCompactionOnlyWhenUseful(t *testing.T) {
+	store := newCountingDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	alice.StoreFile("log", []byte("full"))
+	alice.SetAutoCompaction("log", 2, 4)
+	for i := 0; i < 3; i++ {
+		alice.AppendFile("log", []byte("full"))
+	}
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("log", "alice"))
+
+	// every block is at the target size, so nothing can be merged and the
+	// append reads Metadata once, without starting a compaction
+	store.reset()
+	alice.AppendFile("log", []byte("full"))
+	if store.fetched[metadata.MetadataUUID] != 1 {
+		t.Error("Append over the threshold compacted blocks that could not be merged", store.fetched[metadata.MetadataUUID])
+		return
+	}
+
+	// two small blocks in a row can be
+	alice.AppendFile("log", []byte("a"))
+	alice.AppendFile("log", []byte("b"))
+	metadata, _, _ = verifyFileAccess(*alice, getFilenameHash("log", "alice"))
+	if len(metadata.TextList) != 6 || metadata.TextLengths[5] != 2 {
+		t.Error("Append did not compact blocks that could be merged", metadata.TextLengths)
+		return
+	}
+	checkContents(t, alice, "log", []byte("fullfullfullfullfullab"))
+}
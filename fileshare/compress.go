@@ -0,0 +1,208 @@
+package proj2
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ***************************************** COMPRESSION ********************************* //
+
+// Codecs a file's Text blocks can be compressed with (Metadata.Compression)
+const (
+	CompressionNone  = ""
+	CompressionFlate = "flate" // DEFLATE (RFC 1951) at the default level
+)
+
+// Compresses the data of one Text block with the given codec
+func compressData(codec string, data []byte) (out []byte, err error) {
+	var buf bytes.Buffer
+	var w *flate.Writer
+
+	switch codec {
+	case CompressionNone:
+		return data, nil
+	case CompressionFlate:
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write(data)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, errors.New(strings.ToTitle("unknown compression codec " + codec))
+	}
+}
+
+// DEFLATE cannot expand data by more than this factor, so it bounds blocks
+// whose length Metadata does not record
+const flateMaxRatio = 1032
+
+// Reverses compressData. Only ever called on data whose HMAC has already
+// been verified, so the input was written by someone holding the file keys;
+// still, a block that decompresses past length, its recorded plaintext
+// length, is rejected rather than read in full. A negative length means it
+// is not recorded.
+func decompressData(codec string, data []byte, length int) (out []byte, err error) {
+	switch codec {
+	case CompressionNone:
+		return data, nil
+	case CompressionFlate:
+		if length < 0 {
+			length = len(data) * flateMaxRatio
+		}
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		out, err = io.ReadAll(io.LimitReader(r, int64(length)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > length {
+			userlib.DebugMsg("text block decompresses past its recorded length")
+			return nil, errors.New(strings.ToTitle("text block decompresses past its recorded length"))
+		}
+		return out, nil
+	default:
+		return nil, errors.New(strings.ToTitle("unknown compression codec " + codec))
+	}
+}
+
+// Returns the plaintext length metadata records for the block textUUID, in
+// the current contents or any kept version or pin, or -1 if none does
+func recordedLength(metadata Metadata, textUUID uuid.UUID) (length int) {
+	var find = func(textList []uuid.UUID, lengths []int) int {
+		if len(lengths) != len(textList) {
+			return -1
+		}
+		for i := range textList {
+			if textList[i] == textUUID {
+				return lengths[i]
+			}
+		}
+		return -1
+	}
+
+	if length = find(metadata.TextList, metadata.TextLengths); length >= 0 {
+		return length
+	}
+	for _, v := range metadata.Versions {
+		if length = find(v.TextList, v.TextLengths); length >= 0 {
+			return length
+		}
+	}
+	for _, v := range metadata.Pins {
+		if length = find(v.TextList, v.TextLengths); length >= 0 {
+			return length
+		}
+	}
+	return -1
+}
+
+// Sets the codec the file's Text blocks are compressed with before they are
+// encrypted; CompressionNone turns compression off. The setting lives in
+// the file's Metadata, so every user of the file reads and writes blocks
+// the same way. Existing blocks are re-encoded with the new codec, keeping
+// their boundaries, and the old blocks are deleted once Metadata has been
+// re-posted. Append records do not say which codec their block was written
+// with, so the append log is sealed first and appenders that read the old
+// codec start over.
+//
+// Compressing before encrypting makes the size of each encrypted block
+// depend on what it contains, not only on how long it is. Anyone who can
+// see the Datastore learns how compressible the file is, and if part of it
+// is chosen by someone else, can learn the rest by watching sizes change.
+// Leave compression off for files that mix secrets with data others control.
+func (usr *User) SetCompression(filename string, codec string) (err error) {
+	// variable declarations
+	var metadata, recoded Metadata
+	var text Text
+	var filenameHash string
+	var raw, metadataKey []byte
+	var newList []uuid.UUID
+	var sealed bool
+
+	if _, err = compressData(codec, nil); err != nil {
+		return err
+	}
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+
+	// start over on the current metadata if another writer changes the file first
+	err = retryOnConflict(func() (err error) {
+		newList = nil
+		metadata, metadataKey, raw, err = verifyFileAccessRaw(*usr, filenameHash)
+		if err != nil {
+			userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+			return errors.New(strings.ToTitle("could not verify that user has access to file"))
+		}
+		if metadata.Compression == codec {
+			return nil
+		}
+
+		// blocks appended before the seal are re-encoded with the rest
+		err = sealAppendLog(*usr, &metadata, metadataKey)
+		if err != nil {
+			userlib.DebugMsg("error sealing append log")
+			return err
+		}
+		sealed = true
+
+		// re-post every block under the new codec
+		recoded = metadata
+		recoded.Compression = codec
+		for i := range metadata.TextList {
+			text, err = getText(*usr, metadata, metadata.TextList[i])
+			if err != nil {
+				deleteText(*usr, newList)
+				return err
+			}
+			text.TextUUID = uuid.New()
+			err = postText(*usr, text, recoded)
+			if err != nil {
+				deleteText(*usr, newList)
+				return err
+			}
+			newList = append(newList, text.TextUUID)
+		}
+
+		recoded.TextList = newList
+		recoded.LastModified = usr.Username
+		err = postMetadataCAS(*usr, &recoded, metadataKey, raw)
+		if err != nil {
+			userlib.DebugMsg("error posting file metadata")
+			deleteText(*usr, newList)
+			return err
+		}
+		sealed = false
+		return releaseText(*usr, recoded, metadata.TextList)
+	})
+	if err != nil && sealed {
+		// let appenders back in under the old codec
+		_, _, undoErr := updateMetadata(*usr, filenameHash, func(metadata *Metadata) error {
+			unsealAppendLog(*usr, metadata)
+			metadata.LastModified = usr.Username
+			return nil
+		})
+		if undoErr != nil {
+			userlib.DebugMsg("error moving file metadata past append log seal")
+		}
+	}
+	return err
+}
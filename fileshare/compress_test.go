@@ -0,0 +1,126 @@
+package proj2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Returns the total size of every record in a datastore
+func datastoreSize(store Datastore) (size int) {
+	keys, _ := store.List()
+	for _, key := range keys {
+		v, _ := store.Get(key)
+		size += len(v)
+	}
+	return size
+}
+
+func TestCompression(t *testing.T) {
+	store := NewMemoryDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	bob, _ := InitUserWithBackend(alice.backend, "bob", "bar")
+
+	line := []byte("2026-10-18 12:00:00 INFO request served in 3ms\n")
+	log := bytes.Repeat(line, 200)
+	alice.StoreFile("log", log)
+	plain := datastoreSize(store)
+
+	if err := alice.SetCompression("log", "zstd"); err == nil {
+		t.Error("Accepted an unknown codec")
+		return
+	}
+	if err := alice.SetCompression("log", CompressionFlate); err != nil {
+		t.Error("Failed to turn on compression", err)
+		return
+	}
+	if compressed := datastoreSize(store); compressed > plain-len(log)/2 {
+		t.Error("Compressed file does not take less space", plain, compressed)
+		return
+	}
+	checkContents(t, alice, "log", log)
+
+	// every way of writing and reading agrees on the encoding
+	magic, _ := alice.ShareFile("log", "bob")
+	bob.ReceiveFile("log", "alice", magic)
+	bob.AppendFile("log", line)
+	w, _ := bob.OpenAppender("log")
+	w.Write(line)
+	w.Close()
+	bob.WriteAt("log", []byte("2027"), 0)
+	expected := append(append(append([]byte("2027"), log[4:]...), line...), line...)
+	checkContents(t, alice, "log", expected)
+	r, _ := bob.OpenReader("log")
+	streamed, _ := io.ReadAll(r)
+	if !bytes.Equal(streamed, expected) {
+		t.Error("Streaming read of compressed file is wrong")
+		return
+	}
+	buf := make([]byte, 10)
+	if n, err := alice.ReadAt("log", buf, 100); err != nil || !bytes.Equal(buf[:n], expected[100:110]) {
+		t.Error("ReadAt of compressed file is wrong", err)
+		return
+	}
+	if err := alice.RevokeFile("log", "bob"); err != nil {
+		t.Error("Could not revoke access to compressed file", err)
+		return
+	}
+	checkContents(t, alice, "log", expected)
+
+	// turning it off decodes the blocks again
+	if err := alice.SetCompression("log", CompressionNone); err != nil {
+		t.Error("Failed to turn off compression", err)
+		return
+	}
+	checkContents(t, alice, "log", expected)
+	if datastoreSize(store) < len(expected) {
+		t.Error("File still looks compressed after turning compression off")
+		return
+	}
+}
+
+func TestCompressionAppendRace(t *testing.T) {
+	alice, _ := InitUserWithBackend(Backend{Datastore: NewMemoryDatastore(), Keystore: NewMemoryKeystore()}, "alice", "foo")
+	alice.StoreFile("log", []byte("first;"))
+	alice.AppendFile("log", []byte("second;"))
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+
+	// an appender reads the old codec, then the codec changes under it
+	filenameHash := getFilenameHash("log", "alice")
+	metadata, metadataKey, _, _ := verifyFileAccessHelper(*alice, filenameHash)
+	if err := alice.SetCompression("log", CompressionFlate); err != nil {
+		t.Error("Failed to turn on compression", err)
+		return
+	}
+	text := Text{TextUUID: uuid.New(), Data: []byte("late;")}
+	postText(*alice, text, metadata)
+	_, err := postAppendRecord(*alice, metadata, metadataKey, newAppendRecord(*alice, metadata, text.TextUUID, len(text.Data)))
+	if err != errMetadataConflict {
+		t.Error("Appended a block encoded with the old codec", err)
+		return
+	}
+
+	if err = alice.AppendFile("log", []byte("third;")); err != nil {
+		t.Error("Failed to append after changing the codec", err)
+		return
+	}
+	checkContents(t, alice, "log", []byte("first;second;third;"))
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	alice, _ := InitUserWithBackend(Backend{Datastore: NewMemoryDatastore(), Keystore: NewMemoryKeystore()}, "alice", "foo")
+	alice.StoreFile("log", []byte("short"))
+	alice.SetCompression("log", CompressionFlate)
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("log", "alice"))
+
+	// a block that inflates past the length Metadata records is not read in full
+	bomb := Text{TextUUID: metadata.TextList[0], Data: bytes.Repeat([]byte{0}, 1<<20)}
+	postText(*alice, bomb, metadata)
+	if _, err := alice.LoadFile("log"); err == nil {
+		t.Error("Loaded a block that decompressed past its recorded length")
+		return
+	}
+}
@@ -0,0 +1,204 @@
+package proj2
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ******************************************* DATASTORE ********************************* //
+
+// Datastore is the untrusted key-value store every record is posted to.
+// Implementations must be safe for concurrent use.
+type Datastore interface {
+	// Get returns a copy of the value stored under key
+	Get(key uuid.UUID) (value []byte, ok bool)
+	// Set stores a copy of value under key, replacing any previous value
+	Set(key uuid.UUID, value []byte) error
+	// Delete removes key; deleting a missing key is not an error
+	Delete(key uuid.UUID) error
+	// List returns every key currently in the store, in no particular order
+	List() (keys []uuid.UUID, err error)
+}
+
+// CompareAndSwapper is implemented by datastores that can replace a record
+// only if it still holds the value the writer last read, atomically with
+// respect to every other CompareAndSwap on the same store
+type CompareAndSwapper interface {
+	// CompareAndSwap stores a copy of value under key if the record currently
+	// holds exactly old, or if old is nil and there is no record. It reports
+	// whether the value was stored.
+	CompareAndSwap(key uuid.UUID, old []byte, value []byte) (swapped bool, err error)
+}
+
+// CheckedGetter is implemented by datastores whose reads can fail, e.g.
+// over a network, where Get cannot tell a failed read from a missing record
+type CheckedGetter interface {
+	// GetChecked is Get, but reports a failed read as err rather than as a
+	// missing record
+	GetChecked(key uuid.UUID) (value []byte, ok bool, err error)
+}
+
+// Reads through ds's GetChecked if it has one. Otherwise it falls back to
+// Get, which reports every failure as a missing record.
+func getChecked(ds Datastore, key uuid.UUID) (value []byte, ok bool, err error) {
+	if checked, isChecked := ds.(CheckedGetter); isChecked {
+		return checked.GetChecked(key)
+	}
+	value, ok = ds.Get(key)
+	return value, ok, nil
+}
+
+// Compare-and-swaps through ds if it supports it. Otherwise it falls back to
+// a Get followed by a Set, which cannot notice a writer racing in between.
+func compareAndSwap(ds Datastore, key uuid.UUID, old []byte, value []byte) (swapped bool, err error) {
+	var cur []byte
+	var ok bool
+
+	if cas, isCAS := ds.(CompareAndSwapper); isCAS {
+		return cas.CompareAndSwap(key, old, value)
+	}
+	cur, ok = ds.Get(key)
+	if !casMatches(cur, ok, old) {
+		return false, nil
+	}
+	return true, ds.Set(key, value)
+}
+
+// Reports whether a record (cur, ok) satisfies the expectation old of a
+// CompareAndSwap
+func casMatches(cur []byte, ok bool, old []byte) bool {
+	if old == nil {
+		return !ok
+	}
+	return ok && bytes.Equal(cur, old)
+}
+
+// The structure definition for the set of storage services a User is bound to.
+// Nil fields fall back to the process-global userlib stores.
+type Backend struct {
+	Datastore Datastore
+	Keystore  Keystore
+
+	// How many Text blocks a call may fetch from Datastore at once. Zero
+	// means defaultConcurrency.
+	Concurrency int
+}
+
+// Returns a copy of the backend with every nil service replaced by its userlib
+// default, and an unset Concurrency by defaultConcurrency
+func (backend Backend) withDefaults() Backend {
+	if backend.Concurrency <= 0 {
+		backend.Concurrency = defaultConcurrency
+	}
+	if backend.Datastore == nil {
+		backend.Datastore = UserlibDatastore{}
+	}
+	if backend.Keystore == nil {
+		backend.Keystore = UserlibKeystore{}
+	}
+	return backend
+}
+
+// ************************************** USERLIB ADAPTER ******************************** //
+
+// UserlibDatastore forwards every call to the process-global userlib datastore.
+// It is the datastore used by InitUser and GetUser.
+type UserlibDatastore struct{}
+
+func (UserlibDatastore) Get(key uuid.UUID) (value []byte, ok bool) {
+	return userlib.DatastoreGet(key)
+}
+
+func (UserlibDatastore) Set(key uuid.UUID, value []byte) error {
+	userlib.DatastoreSet(key, value)
+	return nil
+}
+
+func (UserlibDatastore) Delete(key uuid.UUID) error {
+	userlib.DatastoreDelete(key)
+	return nil
+}
+
+// Serializes UserlibDatastore.CompareAndSwap calls. userlib offers no
+// atomic primitive, so a plain Set can still race with a swap.
+var userlibCASMu sync.Mutex
+
+func (UserlibDatastore) CompareAndSwap(key uuid.UUID, old []byte, value []byte) (swapped bool, err error) {
+	userlibCASMu.Lock()
+	defer userlibCASMu.Unlock()
+	cur, ok := userlib.DatastoreGet(key)
+	if !casMatches(cur, ok, old) {
+		return false, nil
+	}
+	userlib.DatastoreSet(key, value)
+	return true, nil
+}
+
+func (UserlibDatastore) List() (keys []uuid.UUID, err error) {
+	for k := range userlib.DatastoreGetMap() {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// ************************************ IN-MEMORY DATASTORE ****************************** //
+
+// MemoryDatastore is a Datastore held entirely in process memory. Unlike
+// UserlibDatastore, every MemoryDatastore is isolated from every other one.
+type MemoryDatastore struct {
+	mu      sync.RWMutex
+	records map[uuid.UUID][]byte
+}
+
+// Creates an empty in-memory datastore
+func NewMemoryDatastore() *MemoryDatastore {
+	return &MemoryDatastore{records: make(map[uuid.UUID][]byte)}
+}
+
+func (store *MemoryDatastore) Get(key uuid.UUID) (value []byte, ok bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	value, ok = store.records[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), value...), true
+}
+
+func (store *MemoryDatastore) Set(key uuid.UUID, value []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.records[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (store *MemoryDatastore) CompareAndSwap(key uuid.UUID, old []byte, value []byte) (swapped bool, err error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	cur, ok := store.records[key]
+	if !casMatches(cur, ok, old) {
+		return false, nil
+	}
+	store.records[key] = append([]byte(nil), value...)
+	return true, nil
+}
+
+func (store *MemoryDatastore) Delete(key uuid.UUID) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.records, key)
+	return nil
+}
+
+func (store *MemoryDatastore) List() (keys []uuid.UUID, err error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	keys = make([]uuid.UUID, 0, len(store.records))
+	for k := range store.records {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
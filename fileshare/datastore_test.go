@@ -0,0 +1,71 @@
+package proj2
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+func TestMemoryDatastore(t *testing.T) {
+	store := NewMemoryDatastore()
+	k := uuid.New()
+	v := []byte("some value")
+
+	if _, ok := store.Get(k); ok {
+		t.Error("Got a value for a key that was never set")
+		return
+	}
+	store.Set(k, v)
+	v[0] = 'S'
+	ret, ok := store.Get(k)
+	if !ok || !reflect.DeepEqual(ret, []byte("some value")) {
+		t.Error("Datastore did not keep its own copy of the value", ret)
+		return
+	}
+	keys, _ := store.List()
+	if len(keys) != 1 || keys[0] != k {
+		t.Error("List did not return the single stored key", keys)
+		return
+	}
+	store.Delete(k)
+	if _, ok := store.Get(k); ok {
+		t.Error("Got a value for a deleted key")
+		return
+	}
+}
+
+func TestDatastoreIsolation(t *testing.T) {
+	clear()
+
+	storeA := NewMemoryDatastore()
+	storeB := NewMemoryDatastore()
+	u, err := InitUserWithBackend(Backend{Datastore: storeA}, "alice", "foo")
+	if err != nil {
+		t.Error("Failed to initialize user on a memory datastore", err)
+		return
+	}
+	v := []byte("This is a test")
+	u.StoreFile("file1", v)
+
+	if len(userlib.DatastoreGetMap()) != 0 {
+		t.Error("User bound to a memory datastore wrote to the userlib datastore")
+		return
+	}
+	if _, err = GetUserWithBackend(Backend{Datastore: storeB}, "alice", "foo"); err == nil {
+		t.Error("Found a user in a datastore it was never stored in")
+		return
+	}
+
+	u2, err := GetUserWithBackend(Backend{Datastore: storeA}, "alice", "foo")
+	if err != nil {
+		t.Error("Failed to get user back from its memory datastore", err)
+		return
+	}
+	v2, err := u2.LoadFile("file1")
+	if err != nil || !reflect.DeepEqual(v, v2) {
+		t.Error("Downloaded file is not the same", v, v2, err)
+		return
+	}
+}
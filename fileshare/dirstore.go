@@ -0,0 +1,206 @@
+package proj2
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ***************************************** SYNC POLICY ********************************* //
+
+// SyncPolicy controls how hard an on-disk store works to make a write
+// durable before reporting success
+type SyncPolicy int
+
+const (
+	// Leave flushing to the operating system. Readers still never see a
+	// half-written record, but after an operating system crash or power loss
+	// a record may be lost, or left empty or truncated, since the rename can
+	// reach the disk before the data does
+	SyncNone SyncPolicy = iota
+	// Fsync every record before it is renamed into place
+	SyncData
+	// Fsync every record and also its directory after each rename or delete,
+	// so that a write that returned is guaranteed to survive a crash
+	SyncAll
+)
+
+// Writes data to path by writing a temporary file in the same directory and
+// renaming it over path, syncing according to policy
+func writeFileAtomic(path string, data []byte, policy SyncPolicy) (err error) {
+	var tmp *os.File
+
+	tmp, err = os.CreateTemp(filepath.Dir(path), tmpPrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	_, err = tmp.Write(data)
+	if err == nil && policy >= SyncData {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	if policy >= SyncAll {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// Fsyncs a directory so that renames and removals inside it are durable
+func syncDir(path string) (err error) {
+	var dir *os.File
+
+	dir, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// ************************************ DIRECTORY DATASTORE ****************************** //
+
+// Prefix of in-flight temporary files; never a valid UUID
+const tmpPrefix = ".tmp-"
+
+// DirDatastore is a Datastore that keeps each record as its own file under a
+// root directory, so that records survive process restarts. Records are
+// fanned out into subdirectories named by the first two hex digits of their
+// UUID. Every write goes to a temporary file that is renamed into place, so
+// readers only ever see a complete old or new record; what survives a crash
+// depends on the SyncPolicy.
+type DirDatastore struct {
+	root   string
+	policy SyncPolicy
+	casMu  sync.Mutex // serializes CompareAndSwap within this process
+}
+
+// Opens (creating if necessary) a directory datastore rooted at root
+func NewDirDatastore(root string, policy SyncPolicy) (store *DirDatastore, err error) {
+	err = os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &DirDatastore{root: root, policy: policy}, nil
+}
+
+// Returns the path of the file holding the record for key
+func (store *DirDatastore) path(key uuid.UUID) string {
+	var name = key.String()
+	return filepath.Join(store.root, name[:2], name)
+}
+
+func (store *DirDatastore) Get(key uuid.UUID) (value []byte, ok bool) {
+	var err error
+
+	value, ok, err = store.GetChecked(key)
+	if err != nil {
+		userlib.DebugMsg("error reading datastore record " + key.String() + ": " + err.Error())
+		return nil, false
+	}
+	return value, ok
+}
+
+func (store *DirDatastore) GetChecked(key uuid.UUID) (value []byte, ok bool, err error) {
+	value, err = os.ReadFile(store.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (store *DirDatastore) Set(key uuid.UUID, value []byte) (err error) {
+	var path = store.path(key)
+	var dir = filepath.Dir(path)
+
+	if _, err = os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+		if store.policy >= SyncAll {
+			err = syncDir(store.root)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writeFileAtomic(path, value, store.policy)
+}
+
+// Swaps are atomic with respect to other swaps through the same
+// DirDatastore only; processes sharing a directory should share a
+// fileshare-server instead.
+func (store *DirDatastore) CompareAndSwap(key uuid.UUID, old []byte, value []byte) (swapped bool, err error) {
+	store.casMu.Lock()
+	defer store.casMu.Unlock()
+	cur, ok := store.Get(key)
+	if !casMatches(cur, ok, old) {
+		return false, nil
+	}
+	return true, store.Set(key, value)
+}
+
+func (store *DirDatastore) Delete(key uuid.UUID) (err error) {
+	var path = store.path(key)
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if store.policy >= SyncAll {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+func (store *DirDatastore) List() (keys []uuid.UUID, err error) {
+	var subdirs, entries []os.DirEntry
+	var key uuid.UUID
+
+	subdirs, err = os.ReadDir(store.root)
+	if err != nil {
+		return nil, err
+	}
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() {
+			continue
+		}
+		entries, err = os.ReadDir(filepath.Join(store.root, subdir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), tmpPrefix) {
+				continue
+			}
+			key, err = uuid.Parse(entry.Name())
+			if err != nil {
+				// not one of ours; leave it alone
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
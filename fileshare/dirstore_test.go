@@ -0,0 +1,91 @@
+package proj2
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDirDatastore(t *testing.T) {
+	root := t.TempDir()
+	store, err := NewDirDatastore(root, SyncAll)
+	if err != nil {
+		t.Error("Failed to create directory datastore", err)
+		return
+	}
+	k := uuid.New()
+	store.Set(k, []byte("version 1"))
+	store.Set(k, []byte("version 2"))
+	ret, ok := store.Get(k)
+	if !ok || !reflect.DeepEqual(ret, []byte("version 2")) {
+		t.Error("Datastore did not return the last value set", string(ret))
+		return
+	}
+	keys, err := store.List()
+	if err != nil || len(keys) != 1 || keys[0] != k {
+		t.Error("List did not return the single stored key", keys, err)
+		return
+	}
+
+	// no temporary files should be left behind
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if strings.HasPrefix(info.Name(), tmpPrefix) {
+			t.Error("Left a temporary file behind", path)
+		}
+		return nil
+	})
+
+	err = store.Delete(k)
+	if err != nil {
+		t.Error("Failed to delete record", err)
+		return
+	}
+	if _, ok = store.Get(k); ok {
+		t.Error("Got a value for a deleted key")
+		return
+	}
+	if err = store.Delete(k); err != nil {
+		t.Error("Deleting a missing key returned an error", err)
+		return
+	}
+}
+
+func TestDirDatastoreSurvivesRestart(t *testing.T) {
+	root := t.TempDir()
+	open := func() Backend {
+		store, err := NewDirDatastore(filepath.Join(root, "datastore"), SyncData)
+		if err != nil {
+			t.Fatal("Failed to open directory datastore", err)
+		}
+		ks, err := NewFileKeystore(filepath.Join(root, "keystore.json"))
+		if err != nil {
+			t.Fatal("Failed to open file keystore", err)
+		}
+		return Backend{Datastore: store, Keystore: ks}
+	}
+
+	u, err := InitUserWithBackend(open(), "alice", "foo")
+	if err != nil {
+		t.Error("Failed to initialize user", err)
+		return
+	}
+	v := []byte("This is a test")
+	u.StoreFile("file1", v)
+	u.AppendFile("file1", []byte(" that survives restarts"))
+
+	// reopen both stores from disk as a new process would
+	u2, err := GetUserWithBackend(open(), "alice", "foo")
+	if err != nil {
+		t.Error("Failed to get user after reopening stores", err)
+		return
+	}
+	v2, err := u2.LoadFile("file1")
+	if err != nil || string(v2) != "This is a test that survives restarts" {
+		t.Error("Downloaded file is not the same after reopening stores", string(v2), err)
+		return
+	}
+}
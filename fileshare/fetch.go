@@ -0,0 +1,77 @@
+package proj2
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ******************************************* BLOCK FETCH ******************************* //
+
+// How many Text blocks are fetched at once when the Backend does not say.
+// Against a remote datastore each fetch is a round trip, so reading a file
+// block by block is bound by latency rather than bandwidth.
+const defaultConcurrency = 8
+
+// Runs do(0) through do(count-1) on up to workers goroutines at once. Once
+// a call fails, no further calls are started and the first error is
+// returned.
+func inParallel(count int, workers int, do func(i int) error) (err error) {
+	// variable declarations
+	var next = make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed bool
+
+	if workers <= 0 {
+		workers = defaultConcurrency
+	}
+	if workers > count {
+		workers = count
+	}
+
+	// each worker takes the index of the next call to make
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				callErr := do(i)
+				mu.Lock()
+				if callErr != nil && !failed {
+					failed = true
+					err = callErr
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		mu.Lock()
+		if failed {
+			mu.Unlock()
+			break
+		}
+		mu.Unlock()
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return err
+}
+
+// Fetches, verifies and decrypts the Text blocks at textUUIDs of the file
+// described by metadata, up to usr.backend.Concurrency of them at a time.
+// texts[i] is the block at textUUIDs[i]; each is checked by getText exactly
+// as if they were fetched one by one.
+func getTexts(usr User, metadata Metadata, textUUIDs []uuid.UUID) (texts []Text, err error) {
+	texts = make([]Text, len(textUUIDs))
+	err = inParallel(len(textUUIDs), usr.backend.Concurrency, func(i int) (err error) {
+		texts[i], err = getText(usr, metadata, textUUIDs[i])
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return texts, nil
+}
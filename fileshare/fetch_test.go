@@ -0,0 +1,79 @@
+package proj2
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// A datastore with a round-trip delay that records how many Gets were in flight at once
+type latencyDatastore struct {
+	Datastore
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (store *latencyDatastore) Get(key uuid.UUID) ([]byte, bool) {
+	store.mu.Lock()
+	store.inFlight++
+	if store.inFlight > store.peak {
+		store.peak = store.inFlight
+	}
+	store.mu.Unlock()
+	time.Sleep(2 * time.Millisecond)
+	store.mu.Lock()
+	store.inFlight--
+	store.mu.Unlock()
+	return store.Datastore.Get(key)
+}
+
+func TestParallelLoadFile(t *testing.T) {
+	store := &latencyDatastore{Datastore: NewMemoryDatastore()}
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore(), Concurrency: 4}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+
+	var expected []byte
+	alice.StoreFile("file1", []byte("block 0;"))
+	expected = append(expected, []byte("block 0;")...)
+	for i := 1; i < 20; i++ {
+		b := []byte("block " + strconv.Itoa(i) + ";")
+		alice.AppendFile("file1", b)
+		expected = append(expected, b...)
+	}
+
+	// blocks come back in order, never more than Concurrency at a time
+	store.peak = 0
+	if !checkContents(t, alice, "file1", expected) {
+		return
+	}
+	if store.peak < 2 || store.peak > 4 {
+		t.Error("LoadFile did not fetch blocks with the configured concurrency", store.peak)
+		return
+	}
+	alice.backend.Concurrency = 1
+	store.peak = 0
+	if !checkContents(t, alice, "file1", expected) {
+		return
+	}
+	if store.peak != 1 {
+		t.Error("LoadFile fetched blocks in parallel with a concurrency of 1", store.peak)
+		return
+	}
+
+	// swapped blocks are still caught when fetched in parallel
+	alice.backend.Concurrency = 4
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	first, _ := store.Datastore.Get(metadata.TextList[3])
+	second, _ := store.Datastore.Get(metadata.TextList[11])
+	store.Datastore.Set(metadata.TextList[3], second)
+	store.Datastore.Set(metadata.TextList[11], first)
+	if _, err := alice.LoadFile("file1"); err == nil {
+		t.Error("LoadFile accepted swapped text blocks")
+		return
+	}
+}
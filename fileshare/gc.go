@@ -0,0 +1,113 @@
+package proj2
+
+import (
+	"time"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ************************************** GARBAGE COLLECTION ***************************** //
+
+// Removes Text records that belong to one of this user's owned files but
+// that the file's TextList no longer references, such as blocks left behind
+// by an interrupted edit or by versions of the code that never deleted
+// superseded blocks. Returns the number of records removed.
+//
+// A record is recognised as belonging to a file only if it verifies under
+// that file's Text MAC key and names its own UUID, so records of other
+// users and files are never touched. A block that is still being written
+// (posted, but not yet linked into the file) looks just like garbage, so
+// an unreferenced block is only removed once an earlier call has also found
+// it unreferenced, at least minAge ago. Every call records the blocks it
+// finds in usr.Garbage for the next one; minAge should comfortably exceed
+// the time a write takes.
+func (usr *User) CollectGarbage(minAge time.Duration) (removed int, err error) {
+	// variable declarations
+	var metadata Metadata
+	var files []Metadata
+	var keys []uuid.UUID
+	var referenced map[uuid.UUID]bool
+	var garbage map[uuid.UUID]int64
+	var val []byte
+	var now, seen int64
+	var ok bool
+
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return 0, err
+	}
+
+	// everything reachable from an owned file is live
+	referenced = make(map[uuid.UUID]bool)
+	for filenameHash, sentinelUUID := range usr.UUIDMap {
+		if usr.OwnerMap[filenameHash] != usr.Username {
+			continue
+		}
+		metadata, _, err = verifyFileAccess(*usr, filenameHash)
+		if err != nil {
+			userlib.DebugMsg("skipping owned file that cannot be verified")
+			continue
+		}
+		files = append(files, metadata)
+		referenced[sentinelUUID] = true
+		referenced[metadata.MetadataUUID] = true
+		for textUUID := range referencedText(metadata) {
+			referenced[textUUID] = true
+		}
+	}
+
+	// anything else that verifies as a Text block of an owned file is garbage;
+	// each record is fetched once and tried against every file's keys
+	keys, err = usr.backend.Datastore.List()
+	if err != nil {
+		userlib.DebugMsg("error listing datastore")
+		return 0, err
+	}
+	now = time.Now().UnixNano()
+	garbage = make(map[uuid.UUID]int64)
+	for _, key := range keys {
+		if referenced[key] {
+			continue
+		}
+		val, ok = usr.backend.Datastore.Get(key)
+		if !ok {
+			continue
+		}
+		for _, metadata = range files {
+			if _, err = openText(metadata, key, val); err != nil {
+				continue
+			}
+			// give a block that is still being written time to be linked
+			seen, ok = usr.Garbage[key]
+			if !ok {
+				garbage[key] = now
+				break
+			}
+			if now-seen < int64(minAge) {
+				garbage[key] = seen
+				break
+			}
+			err = usr.backend.Datastore.Delete(key)
+			if err != nil {
+				userlib.DebugMsg("error deleting orphaned text block")
+				return removed, err
+			}
+			removed++
+			break
+		}
+	}
+
+	// remember what is left for the next call; blocks that were linked in
+	// since the last one are forgotten
+	err = updateUser(usr, func(usr *User) error {
+		usr.Garbage = garbage
+		return nil
+	})
+	if err != nil {
+		userlib.DebugMsg("error saving garbage candidates")
+		return removed, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,127 @@
+package proj2
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestStoreFileDeletesOldBlocks(t *testing.T) {
+	store := NewMemoryDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+
+	alice.StoreFile("file1", []byte("first"))
+	alice.AppendFile("file1", []byte(", second"))
+	alice.AppendFile("file1", []byte(", third"))
+	keys, _ := store.List()
+	before := len(keys)
+
+	alice.StoreFile("file1", []byte("overwritten"))
+	keys, _ = store.List()
+	if len(keys) != before-2 {
+		t.Error("Overwriting a file did not delete its old blocks", before, len(keys))
+		return
+	}
+	checkContents(t, alice, "file1", []byte("overwritten"))
+}
+
+func TestCollectGarbage(t *testing.T) {
+	store := NewMemoryDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	bob, _ := InitUserWithBackend(alice.backend, "bob", "bar")
+
+	alice.StoreFile("file1", []byte("alice's file"))
+	alice.AppendFile("file1", []byte(", appended"))
+	bob.StoreFile("file2", []byte("bob's file"))
+	magic, _ := bob.ShareFile("file2", "alice")
+	alice.ReceiveFile("from bob", "bob", magic)
+
+	// orphan a block of each file the way an interrupted write would
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	mine, mineKey, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	theirs, _, _ := verifyFileAccess(*alice, getFilenameHash("from bob", "alice"))
+	orphan := Text{TextUUID: uuid.New(), Data: []byte("orphan")}
+	postText(*alice, orphan, mine)
+	notMine := Text{TextUUID: uuid.New(), Data: []byte("not alice's")}
+	postText(*bob, notMine, theirs)
+	keys, _ := store.List()
+	before := len(keys)
+
+	// the first pass only notes the orphan, which might still be linked in
+	removed, err := alice.CollectGarbage(0)
+	if err != nil || removed != 0 {
+		t.Error("CollectGarbage removed a block found for the first time", removed, err)
+		return
+	}
+	if removed, err = alice.CollectGarbage(time.Hour); err != nil || removed != 0 {
+		t.Error("CollectGarbage removed a block found too recently", removed, err)
+		return
+	}
+	removed, err = alice.CollectGarbage(0)
+	if err != nil || removed != 1 {
+		t.Error("CollectGarbage did not remove exactly the orphaned block", removed, err)
+		return
+	}
+	if _, ok := store.Get(orphan.TextUUID); ok {
+		t.Error("Orphaned block is still in the datastore")
+		return
+	}
+	if _, ok := store.Get(notMine.TextUUID); !ok {
+		t.Error("CollectGarbage removed a block of a file the user does not own")
+		return
+	}
+	keys, _ = store.List()
+	if len(keys) != before-1 {
+		t.Error("CollectGarbage removed live records", before, len(keys))
+		return
+	}
+	checkContents(t, alice, "file1", []byte("alice's file, appended"))
+	checkContents(t, alice, "from bob", []byte("bob's file"))
+
+	// a block linked in after it was first found is kept
+	pending := Text{TextUUID: uuid.New(), Data: []byte(", linked late")}
+	postText(*alice, pending, mine)
+	alice.CollectGarbage(0)
+	postAppendRecord(*alice, mine, mineKey, newAppendRecord(*alice, mine, pending.TextUUID, len(pending.Data)))
+	if removed, err = alice.CollectGarbage(0); err != nil || removed != 0 {
+		t.Error("CollectGarbage removed a block linked in since the last pass", removed, err)
+		return
+	}
+	if !checkContents(t, alice, "file1", []byte("alice's file, appended, linked late")) {
+		return
+	}
+
+	// a second pass finds nothing
+	if removed, err = alice.CollectGarbage(0); err != nil || removed != 0 {
+		t.Error("Second garbage collection removed records", removed, err)
+		return
+	}
+}
+
+func TestCollectGarbageFetchesOnce(t *testing.T) {
+	store := newCountingDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	for i := 0; i < 5; i++ {
+		alice.StoreFile("file"+strconv.Itoa(i), []byte("contents"))
+	}
+	var strays []uuid.UUID
+	for i := 0; i < 50; i++ {
+		strays = append(strays, uuid.New())
+		store.Set(strays[i], []byte("stray"))
+	}
+
+	// records no file refers to are fetched once, not once per owned file
+	store.reset()
+	if _, err := alice.CollectGarbage(0); err != nil {
+		t.Error("CollectGarbage failed", err)
+		return
+	}
+	for _, key := range strays {
+		if store.fetched[key] != 1 {
+			t.Error("CollectGarbage fetched a record more than once", store.fetched[key])
+			return
+		}
+	}
+}
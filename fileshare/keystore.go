@@ -0,0 +1,173 @@
+package proj2
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/cs161-staff/userlib"
+)
+
+// ******************************************* KEYSTORE ********************************** //
+
+// Keystore is the trusted public-key directory. Entries are write-once:
+// Set must fail if the key has already been taken.
+// Implementations must be safe for concurrent use.
+type Keystore interface {
+	// Get returns the public key stored under key
+	Get(key string) (value userlib.PublicKeyType, ok bool)
+	// Set stores value under key, failing if key is already taken
+	Set(key string, value userlib.PublicKeyType) error
+}
+
+// ************************************** USERLIB ADAPTER ******************************** //
+
+// UserlibKeystore forwards every call to the process-global userlib keystore.
+// It is the keystore used by InitUser and GetUser.
+type UserlibKeystore struct{}
+
+func (UserlibKeystore) Get(key string) (value userlib.PublicKeyType, ok bool) {
+	return userlib.KeystoreGet(key)
+}
+
+func (UserlibKeystore) Set(key string, value userlib.PublicKeyType) error {
+	return userlib.KeystoreSet(key, value)
+}
+
+// ************************************* IN-MEMORY KEYSTORE ****************************** //
+
+// MemoryKeystore is a Keystore held entirely in process memory
+type MemoryKeystore struct {
+	mu      sync.RWMutex
+	entries map[string]userlib.PublicKeyType
+}
+
+// Creates an empty in-memory keystore
+func NewMemoryKeystore() *MemoryKeystore {
+	return &MemoryKeystore{entries: make(map[string]userlib.PublicKeyType)}
+}
+
+func (ks *MemoryKeystore) Get(key string) (value userlib.PublicKeyType, ok bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	value, ok = ks.entries[key]
+	return value, ok
+}
+
+func (ks *MemoryKeystore) Set(key string, value userlib.PublicKeyType) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, ok := ks.entries[key]; ok {
+		return errors.New(strings.ToTitle("keystore entry is already taken"))
+	}
+	ks.entries[key] = value
+	return nil
+}
+
+// *************************************** FILE KEYSTORE ********************************* //
+
+// FileKeystore is a Keystore persisted as a single JSON file, so that its
+// entries survive process restarts. Every Set rewrites the file atomically.
+// Entries written by other processes sharing the file are picked up the next
+// time a missing key is looked up, but only one process may write: the file
+// is not locked, so two processes calling Set at once can lose one entry.
+type FileKeystore struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]userlib.PublicKeyType
+}
+
+// Opens the keystore file at path, creating an empty keystore if the file does not exist
+func NewFileKeystore(path string) (ks *FileKeystore, err error) {
+	ks = &FileKeystore{path: path}
+	err = ks.load()
+	if err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reloads all entries from disk; the caller must hold ks.mu (or own ks exclusively)
+func (ks *FileKeystore) load() (err error) {
+	var data []byte
+	var entries = make(map[string]userlib.PublicKeyType)
+
+	data, err = os.ReadFile(ks.path)
+	if errors.Is(err, os.ErrNotExist) {
+		ks.entries = entries
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		userlib.DebugMsg("error unmarshalling keystore file " + ks.path)
+		return err
+	}
+	ks.entries = entries
+	return nil
+}
+
+func (ks *FileKeystore) Get(key string) (value userlib.PublicKeyType, ok bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	value, ok = ks.entries[key]
+	if !ok && ks.load() == nil {
+		value, ok = ks.entries[key]
+	}
+	return value, ok
+}
+
+func (ks *FileKeystore) Set(key string, value userlib.PublicKeyType) (err error) {
+	var data []byte
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	// reload first to pick up entries another process wrote earlier; nothing
+	// stops one writing between this load and the write below
+	err = ks.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := ks.entries[key]; ok {
+		return errors.New(strings.ToTitle("keystore entry is already taken"))
+	}
+	ks.entries[key] = value
+	data, err = json.Marshal(ks.entries)
+	if err != nil {
+		delete(ks.entries, key)
+		return err
+	}
+	err = writeFileAtomic(ks.path, data, SyncAll)
+	if err != nil {
+		delete(ks.entries, key)
+		return err
+	}
+	return nil
+}
+
+// ************************************** READ-ONLY KEYSTORE ***************************** //
+
+// The structure definition for a Keystore wrapper that rejects all writes
+type readOnlyKeystore struct {
+	ks Keystore
+}
+
+// Wraps ks so that lookups pass through but every Set fails. Clients that
+// only need to verify signatures can use it to guarantee they never
+// publish keys.
+func NewReadOnlyKeystore(ks Keystore) Keystore {
+	return readOnlyKeystore{ks: ks}
+}
+
+func (ro readOnlyKeystore) Get(key string) (value userlib.PublicKeyType, ok bool) {
+	return ro.ks.Get(key)
+}
+
+func (ro readOnlyKeystore) Set(key string, value userlib.PublicKeyType) error {
+	return errors.New(strings.ToTitle("keystore is read-only"))
+}
@@ -0,0 +1,82 @@
+package proj2
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cs161-staff/userlib"
+)
+
+func TestFileKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	ks, err := NewFileKeystore(path)
+	if err != nil {
+		t.Error("Failed to create file keystore", err)
+		return
+	}
+	pub, _, _ := userlib.PKEKeyGen()
+	err = ks.Set("alice-PKEEncKey", pub)
+	if err != nil {
+		t.Error("Failed to set keystore entry", err)
+		return
+	}
+	err = ks.Set("alice-PKEEncKey", pub)
+	if err == nil {
+		t.Error("Keystore allowed an entry to be overwritten")
+		return
+	}
+
+	// reopen the keystore as if the process had restarted
+	ks2, err := NewFileKeystore(path)
+	if err != nil {
+		t.Error("Failed to reopen file keystore", err)
+		return
+	}
+	ret, ok := ks2.Get("alice-PKEEncKey")
+	if !ok || !reflect.DeepEqual(ret, pub) {
+		t.Error("Keystore entry did not survive reopening the keystore")
+		return
+	}
+}
+
+func TestReadOnlyKeystore(t *testing.T) {
+	ks := NewMemoryKeystore()
+	pub, _, _ := userlib.PKEKeyGen()
+	ks.Set("alice-PKEEncKey", pub)
+
+	ro := NewReadOnlyKeystore(ks)
+	if _, ok := ro.Get("alice-PKEEncKey"); !ok {
+		t.Error("Read-only keystore hid an existing entry")
+		return
+	}
+	if err := ro.Set("bob-PKEEncKey", pub); err == nil {
+		t.Error("Read-only keystore accepted a write")
+		return
+	}
+	if _, err := InitUserWithBackend(Backend{Datastore: NewMemoryDatastore(), Keystore: ro}, "bob", "bar"); err == nil {
+		t.Error("Initialized a user against a read-only keystore")
+		return
+	}
+}
+
+func TestBackendIsolation(t *testing.T) {
+	clear()
+
+	b1 := Backend{Datastore: NewMemoryDatastore(), Keystore: NewMemoryKeystore()}
+	b2 := Backend{Datastore: NewMemoryDatastore(), Keystore: NewMemoryKeystore()}
+	_, err := InitUserWithBackend(b1, "alice", "foo")
+	if err != nil {
+		t.Error("Failed to initialize alice in first backend", err)
+		return
+	}
+	_, err = InitUserWithBackend(b2, "alice", "foo")
+	if err != nil {
+		t.Error("Username in one backend blocked the same username in another", err)
+		return
+	}
+	if _, ok := userlib.KeystoreGet("alice-PKEEncKey"); ok {
+		t.Error("User bound to a memory keystore wrote to the userlib keystore")
+		return
+	}
+}
@@ -0,0 +1,240 @@
+package proj2
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ******************************************* NAMESPACE ********************************* //
+
+// The structure definition for one file in a user's namespace
+type FileEntry struct {
+	Name  string // the name this user knows the file by
+	Owner string // the user who created the file
+	Owned bool   // true if this user is the owner, false if the file was received
+}
+
+// Lists every file this user has stored or received, sorted by name.
+//
+// Names come from the filename index kept inside the (encrypted) User
+// struct, so the datastore learns nothing about them. Files stored before
+// the index existed are not listed. Neither are files this user can no
+// longer open because the owner deleted them or revoked this user's
+// access; their Sentinel is fetched to tell.
+func (usr *User) ListFiles() (files []FileEntry, err error) {
+	// variable declarations
+	var sentinel Sentinel
+	var sentinelUUID uuid.UUID
+	var ok bool
+
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return nil, err
+	}
+
+	files = []FileEntry{}
+	for filenameHash, name := range usr.NameMap {
+		if sentinelUUID, ok = usr.UUIDMap[filenameHash]; !ok {
+			continue
+		}
+		sentinel, err = getSentinel(*usr, sentinelUUID)
+		if err != nil {
+			continue
+		}
+		if _, ok = sentinel.MetadataKeyMap[usr.Username]; !ok {
+			continue
+		}
+		owner := usr.OwnerMap[filenameHash]
+		files = append(files, FileEntry{Name: name, Owner: owner, Owned: owner == usr.Username})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// Deletes a file from this user's namespace.
+//
+// If this user owns the file, the file itself is destroyed: its Sentinel,
+// Metadata and every Text block (kept versions included) are removed from
+// the datastore, which also takes away every sharee's access. If the file was received, only this
+// user's namespace entry and their key in the file Sentinel are removed;
+// the file and everyone else's access are left alone.
+func (usr *User) DeleteFile(filename string) (err error) {
+	// variable declarations
+	var metadata Metadata
+	var sentinelUUID uuid.UUID
+	var filenameHash string
+	var ok, owned bool
+
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	sentinelUUID, ok = usr.UUIDMap[filenameHash]
+	if !ok {
+		userlib.DebugMsg("cannot find UUID of file sentinel!")
+		return errors.New(strings.ToTitle("user cannot find UUID of file sentinel!"))
+	}
+
+	// a received file we can no longer verify (e.g. access was revoked) just
+	// leaves the namespace; an owned one has to be verified to be cleaned up.
+	// A failed verification drops the entry from usr's maps, so look first.
+	owned = usr.OwnerMap[filenameHash] == usr.Username
+	metadata, _, err = verifyFileAccess(*usr, filenameHash)
+	if err != nil && owned {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return err
+	}
+	if err == nil {
+		if metadata.Owner == usr.Username {
+			// remove the sentinel first so that every sharee loses access at once
+			err = usr.backend.Datastore.Delete(sentinelUUID)
+			if err != nil {
+				userlib.DebugMsg("error deleting file sentinel")
+				return err
+			}
+			err = usr.backend.Datastore.Delete(metadata.MetadataUUID)
+			if err != nil {
+				userlib.DebugMsg("error deleting file metadata")
+				return err
+			}
+			for _, logID := range appendLogIDs(metadata) {
+				err = deleteAppendLog(*usr, logID)
+				if err != nil {
+					return err
+				}
+			}
+			for textUUID := range referencedText(metadata) {
+				err = usr.backend.Datastore.Delete(textUUID)
+				if err != nil {
+					userlib.DebugMsg("error deleting text block")
+					return err
+				}
+			}
+			// along with a revocation that was interrupted before it copied anything
+			err = usr.backend.Datastore.Delete(revokeJournalUUID(metadata.MetadataUUID))
+			if err != nil {
+				userlib.DebugMsg("error deleting revocation journal")
+				return err
+			}
+		} else {
+			// leave the access tree, then give up the Metadata key
+			_, _, err = updateMetadata(*usr, filenameHash, func(metadata *Metadata) error {
+				leaveAccess(metadata.AccessMap, usr.Username)
+				metadata.LastModified = usr.Username
+				return nil
+			})
+			if err != nil {
+				userlib.DebugMsg("error removing user from file access map")
+				return err
+			}
+			err = updateSentinel(*usr, sentinelUUID, func(sentinel *Sentinel) error {
+				delete(sentinel.MetadataKeyMap, usr.Username)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// drop the namespace entry and save, unless another session has already
+	// pointed the name at a different file
+	err = updateUser(usr, func(usr *User) error {
+		if usr.UUIDMap[filenameHash] == sentinelUUID {
+			delete(usr.UUIDMap, filenameHash)
+			delete(usr.OwnerMap, filenameHash)
+			delete(usr.NameMap, filenameHash)
+		}
+		return nil
+	})
+	if err != nil {
+		userlib.DebugMsg("error posting user struct")
+		return err
+	}
+	return nil
+}
+
+// Removes username from accessMap. Whoever username shared the file with
+// moves up to username's parent, so they keep their access and the owner
+// can still revoke them through the parent.
+func leaveAccess(accessMap map[string][]string, username string) {
+	var list []string
+	var found bool
+
+	for parent, children := range accessMap {
+		list, found = nil, false
+		for _, n := range children {
+			if n == username {
+				list = append(list, accessMap[username]...)
+				found = true
+			} else {
+				list = append(list, n)
+			}
+		}
+		if found {
+			accessMap[parent] = list
+		}
+	}
+	delete(accessMap, username)
+}
+
+// Renames a file in this user's namespace. Works for owned and received
+// files alike and leaves all sharing intact, since only this user's
+// namespace entry refers to the file by name. Fails if newFilename is
+// already taken. The move is committed by a single post of the User struct,
+// so other sessions see either the old name or the new one, never both.
+func (usr *User) RenameFile(oldFilename string, newFilename string) (err error) {
+	// variable declarations
+	var oldHash, newHash string
+	var sentinelUUID uuid.UUID
+	var ok bool
+
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	oldHash = getFilenameHash(oldFilename, usr.Username)
+	newHash = getFilenameHash(newFilename, usr.Username)
+	if _, ok = usr.UUIDMap[oldHash]; !ok {
+		userlib.DebugMsg("cannot find UUID of file sentinel!")
+		return errors.New(strings.ToTitle("user cannot find UUID of file sentinel!"))
+	}
+	if _, ok = usr.UUIDMap[newHash]; ok {
+		userlib.DebugMsg("File exists in user struct")
+		return errFileExists
+	}
+	sentinelUUID = usr.UUIDMap[oldHash]
+
+	// move the namespace entry and save, checking again against the
+	// namespace as other sessions have left it
+	err = updateUser(usr, func(usr *User) error {
+		if usr.UUIDMap[oldHash] != sentinelUUID {
+			userlib.DebugMsg("file was renamed or replaced by another session")
+			return errors.New(strings.ToTitle("file was changed by another session"))
+		}
+		if _, ok := usr.UUIDMap[newHash]; ok {
+			userlib.DebugMsg("File exists in user struct")
+			return errFileExists
+		}
+		usr.UUIDMap[newHash] = usr.UUIDMap[oldHash]
+		usr.OwnerMap[newHash] = usr.OwnerMap[oldHash]
+		usr.NameMap[newHash] = newFilename
+		delete(usr.UUIDMap, oldHash)
+		delete(usr.OwnerMap, oldHash)
+		delete(usr.NameMap, oldHash)
+		return nil
+	})
+	if err != nil {
+		userlib.DebugMsg("error posting user struct")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,267 @@
+package proj2
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/cs161-staff/userlib"
+)
+
+func TestListFiles(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	bob, _ := InitUser("bob", "bar")
+
+	files, err := alice.ListFiles()
+	if err != nil || len(files) != 0 {
+		t.Error("New user has files", files, err)
+		return
+	}
+
+	alice.StoreFile("zebra", []byte("z"))
+	alice.StoreFile("apple", []byte("a"))
+	alice.StoreFile("apple", []byte("a again"))
+	bob.StoreFile("bobfile", []byte("b"))
+	magic, _ := bob.ShareFile("bobfile", "alice")
+	alice.ReceiveFile("from bob", "bob", magic)
+
+	// a second session sees the same listing
+	alice2, _ := GetUser("alice", "foo")
+	files, err = alice2.ListFiles()
+	if err != nil {
+		t.Error("Failed to list files", err)
+		return
+	}
+	expected := []FileEntry{
+		{Name: "apple", Owner: "alice", Owned: true},
+		{Name: "from bob", Owner: "bob", Owned: false},
+		{Name: "zebra", Owner: "alice", Owned: true},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Error("Listing is not what was expected", files)
+		return
+	}
+
+	// filenames never reach the datastore in plaintext
+	for _, v := range userlib.DatastoreGetMap() {
+		if bytes.Contains(v, []byte("zebra")) {
+			t.Error("Datastore saw a plaintext filename")
+			return
+		}
+	}
+
+	// files the owner deleted or revoked access to are not listed
+	bob.StoreFile("revoked", []byte("r"))
+	magic, _ = bob.ShareFile("revoked", "alice")
+	alice.ReceiveFile("revoked by bob", "bob", magic)
+	bob.RevokeFile("revoked", "alice")
+	bob.DeleteFile("bobfile")
+	files, err = alice.ListFiles()
+	expected = []FileEntry{
+		{Name: "apple", Owner: "alice", Owned: true},
+		{Name: "zebra", Owner: "alice", Owned: true},
+	}
+	if err != nil || !reflect.DeepEqual(files, expected) {
+		t.Error("Listing includes files that can no longer be opened", files, err)
+		return
+	}
+}
+
+func TestDeleteFileOwner(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	bob, _ := InitUser("bob", "bar")
+	alice.StoreFile("file1", []byte("This is a test"))
+	alice.AppendFile("file1", []byte(" with two blocks"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+
+	// a revocation that was interrupted right after posting its journal
+	alice, _ = GetUser("alice", "foo")
+	filenameHash := getFilenameHash("file1", "alice")
+	metadata, _, _ := verifyFileAccess(*alice, filenameHash)
+	sentinel, _ := getSentinel(*alice, alice.UUIDMap[filenameHash])
+	journal := RevokeJournal{MetadataUUID: metadata.MetadataUUID, Target: "bob", OldLock: sentinel.Lock, Revision: metadata.Revision}
+	if _, err := postRevokeJournal(*alice, journal, nil); err != nil {
+		t.Error("Failed to post revocation journal", err)
+		return
+	}
+	before := len(userlib.DatastoreGetMap())
+
+	err := alice.DeleteFile("file1")
+	if err != nil {
+		t.Error("Owner failed to delete file", err)
+		return
+	}
+	// sentinel, metadata, append record, both text blocks and the journal are
+	// gone; only the re-posted users remain
+	if after := len(userlib.DatastoreGetMap()); after != before-6 {
+		t.Error("Deleting file did not remove all of its records", before, after)
+		return
+	}
+	if _, ok := userlib.DatastoreGet(revokeJournalUUID(metadata.MetadataUUID)); ok {
+		t.Error("Deleting file left its revocation journal behind")
+		return
+	}
+	if _, err = alice.LoadFile("file1"); err == nil {
+		t.Error("Owner could still load deleted file")
+		return
+	}
+	if _, err = bob.LoadFile("shared"); err == nil {
+		t.Error("Sharee could still load deleted file")
+		return
+	}
+	files, _ := alice.ListFiles()
+	if len(files) != 0 {
+		t.Error("Deleted file is still listed", files)
+		return
+	}
+	if err = alice.DeleteFile("file1"); err == nil {
+		t.Error("Deleted a file that does not exist")
+		return
+	}
+
+	// the name can be reused for a brand new file
+	alice.StoreFile("file1", []byte("new"))
+	if v, err := alice.LoadFile("file1"); err != nil || string(v) != "new" {
+		t.Error("Could not reuse the name of a deleted file", err)
+		return
+	}
+}
+
+func TestDeleteFileRecipient(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	bob, _ := InitUser("bob", "bar")
+	v := []byte("This is a test")
+	alice.StoreFile("file1", v)
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+	carol, _ := InitUser("carol", "baz")
+	magic, _ = bob.ShareFile("shared", "carol")
+	carol.ReceiveFile("shared", "bob", magic)
+
+	err := bob.DeleteFile("shared")
+	if err != nil {
+		t.Error("Recipient failed to delete file", err)
+		return
+	}
+	if _, err = bob.LoadFile("shared"); err == nil {
+		t.Error("Recipient could still load file it deleted")
+		return
+	}
+	v2, err := alice.LoadFile("file1")
+	if err != nil || !reflect.DeepEqual(v, v2) {
+		t.Error("Recipient deleting its copy affected the owner", err)
+		return
+	}
+	alice, _ = GetUser("alice", "foo")
+	sentinel, err := getSentinel(*alice, alice.UUIDMap[getFilenameHash("file1", "alice")])
+	if err != nil {
+		t.Error("Could not read file sentinel", err)
+		return
+	}
+	if _, ok := sentinel.MetadataKeyMap["bob"]; ok {
+		t.Error("Recipient's key was left in the file sentinel")
+		return
+	}
+
+	// whoever the recipient shared with moves up to the owner
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if accessContains(metadata.AccessMap, "bob") || !shared("alice", "carol", metadata.AccessMap) {
+		t.Error("Recipient was not taken out of the access tree", metadata.AccessMap)
+		return
+	}
+	if !checkContents(t, carol, "shared", v) {
+		return
+	}
+	if err = alice.RevokeFile("file1", "carol"); err != nil {
+		t.Error("Owner could not revoke a user the recipient had shared with", err)
+		return
+	}
+}
+
+func TestDeleteFileOwnerUnverified(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	alice.StoreFile("file1", []byte("This is a test"))
+	alice, _ = GetUser("alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+
+	// the owner's records are not dropped blindly when Metadata is tampered with
+	val, _ := userlib.DatastoreGet(metadata.MetadataUUID)
+	val[len(val)-1] ^= 1
+	userlib.DatastoreSet(metadata.MetadataUUID, val)
+	if err := alice.DeleteFile("file1"); err == nil {
+		t.Error("Owner deleted a file it could not verify")
+		return
+	}
+	if files, _ := alice.ListFiles(); len(files) != 1 {
+		t.Error("File left the owner's namespace without being cleaned up", files)
+		return
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	bob, _ := InitUser("bob", "bar")
+	alice.StoreFile("file1", []byte("This is a test"))
+	alice.StoreFile("file2", []byte("Another file"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+
+	if err := alice.RenameFile("file1", "file2"); err == nil {
+		t.Error("Renamed a file over an existing one")
+		return
+	}
+	if err := alice.RenameFile("nonexistent", "file3"); err == nil {
+		t.Error("Renamed a file that does not exist")
+		return
+	}
+	if err := alice.RenameFile("file1", "renamed"); err != nil {
+		t.Error("Owner failed to rename file", err)
+		return
+	}
+	if err := bob.RenameFile("shared", "mine now"); err != nil {
+		t.Error("Recipient failed to rename file", err)
+		return
+	}
+	if _, err := alice.LoadFile("file1"); err == nil {
+		t.Error("File is still reachable under its old name")
+		return
+	}
+
+	// sharing survives both renames in both directions
+	bob.AppendFile("mine now", []byte(", appended by bob"))
+	alice.AppendFile("renamed", []byte(", appended by alice"))
+	for _, check := range []struct {
+		u    *User
+		name string
+	}{{alice, "renamed"}, {bob, "mine now"}} {
+		v, err := check.u.LoadFile(check.name)
+		if err != nil || string(v) != "This is a test, appended by bob, appended by alice" {
+			t.Error("Renamed file lost its contents or sharing", check.u.Username, string(v), err)
+			return
+		}
+	}
+	files, _ := bob.ListFiles()
+	if len(files) != 1 || files[0].Name != "mine now" || files[0].Owned {
+		t.Error("Listing does not reflect rename", files)
+		return
+	}
+	if err := alice.RevokeFile("renamed", "bob"); err != nil {
+		t.Error("Could not revoke access to a renamed file", err)
+		return
+	}
+	if _, err := bob.LoadFile("mine now"); err == nil {
+		t.Error("Revoked recipient can still load renamed file")
+		return
+	}
+}
@@ -41,12 +41,17 @@ import (
 
 // The structure definition for a user record
 type User struct {
-	Username string
-	password string
-	PKEDec   userlib.PKEDecKey
-	DSSign   userlib.DSSignKey
-	UUIDMap  map[string]uuid.UUID
-	OwnerMap map[string]string
+	Username  string
+	password  string
+	PKEDec    userlib.PKEDecKey
+	DSSign    userlib.DSSignKey
+	UUIDMap   map[string]uuid.UUID
+	OwnerMap  map[string]string
+	NameMap   map[string]string      // filename hash -> plaintext filename, for ListFiles
+	Snapshots map[string]SnapshotRef // snapshot label -> where its record is kept
+	Garbage   map[uuid.UUID]int64    // unreferenced Text blocks -> when CollectGarbage first found them, in Unix nanoseconds
+	backend   Backend
+	session   *userSession // password-derived keys, cached for this login
 }
 
 // The structure definition for a File Sentinel record
@@ -71,6 +76,25 @@ type Metadata struct {
 	TextEncKey   []byte
 	TextMACKey   []byte
 	TextList     []uuid.UUID
+	TextLengths  []int // plaintext length of each block in TextList; nil if unknown
+	ModTime      int64 // when the contents last changed, in Unix nanoseconds
+
+	CompactThreshold int // AppendFile compacts once TextList is longer than this; 0 disables
+	CompactBlockSize int // target block size for automatic compaction
+
+	Compression string // codec Text.Data is compressed with before encryption; "" for none
+
+	VersionNumber int       // number of the current contents; bumped by every StoreFile
+	Versions      []Version // earlier contents kept for LoadFileVersion, oldest first
+	KeepVersions  int       // how many earlier versions to keep; 0 keeps none
+
+	Pins map[string]Version // contents held for snapshots, keyed by snapshot record UUID
+
+	Revision uint64 // bumped by every post, so writers can tell their read is stale
+
+	AppendLog         uuid.UUID   // names the append log's slots; replaced on every re-key. uuid.Nil means MetadataUUID
+	RetiredAppendLogs []uuid.UUID // sealed logs of earlier keys, kept so that stale appenders find the seal
+	AppendsFolded     int         // append log slots before this index are reflected in TextList
 }
 
 // The structure definition for a File Text Block record
@@ -125,9 +149,17 @@ func pad(data []byte) []byte {
 	return ret
 }
 
-// Unpads data from block cipher blocklen (16 bytes) according to padding scheme
+// Unpads data from block cipher blocklen (16 bytes) according to padding scheme.
+// Data decrypted under the wrong key has garbage padding; it is returned
+// as is and left for unmarshalling to reject.
 func unpad(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
 	var bytesToRemove = int(data[len(data)-1])
+	if bytesToRemove > len(data) {
+		return data
+	}
 	return data[:len(data)-bytesToRemove]
 }
 
@@ -224,30 +256,51 @@ func removeAccess(accessMap map[string][]string, a string, b string) (newAccessM
 // Takes care of marshalling, padding, (salting), encrypting, authenticating
 // Authenticates with symMAC if sign = false, otherwise authenticates with DSSign
 func postStruct(obj interface{}, newUUID uuid.UUID, symEnc []byte, symMAC []byte, salt []byte, usr User, sign bool) (err error) {
+	var val []byte
+
+	val, err = sealStruct(obj, symEnc, symMAC, salt, usr, sign)
+	if err != nil {
+		return err
+	}
+	err = usr.backend.Datastore.Set(newUUID, val)
+	if err != nil {
+		userlib.DebugMsg("error storing object in datastore")
+		return err
+	}
+	return nil
+}
+
+// Does everything postStruct does short of storing the result, which it
+// returns instead
+func sealStruct(obj interface{}, symEnc []byte, symMAC []byte, salt []byte, usr User, sign bool) (val []byte, err error) {
 	// variable declarations
-	var plaintext, ciphertext, auth, val []byte
+	var plaintext, ciphertext, auth []byte
 
 	// get plaintext and pad
-	plaintext, err = json.Marshal(obj)
+	if marshaler, ok := obj.(recordMarshaler); ok {
+		plaintext, err = marshaler.marshalRecord()
+	} else {
+		plaintext, err = json.Marshal(obj)
+	}
 	if err != nil {
 		userlib.DebugMsg("error when marshalling object")
-		return err
+		return nil, err
 	}
 	plaintext = pad(plaintext)
 
-	// encrypt, authenticate, and store data into datastore
+	// encrypt and authenticate
 	ciphertext = userlib.SymEnc(symEnc, userlib.RandomBytes(userlib.AESBlockSize), plaintext)
 	if !sign && symMAC != nil {
 		auth, err = userlib.HMACEval(symMAC, ciphertext)
 		if err != nil {
 			userlib.DebugMsg("error computing HMAC of object ciphertext")
-			return err
+			return nil, err
 		}
 	} else {
 		auth, err = userlib.DSSign(usr.DSSign, ciphertext)
 		if err != nil {
 			userlib.DebugMsg("error signing object ciphertext")
-			return err
+			return nil, err
 		}
 	}
 	if salt != nil {
@@ -256,24 +309,21 @@ func postStruct(obj interface{}, newUUID uuid.UUID, symEnc []byte, symMAC []byte
 	} else {
 		val = append(auth, ciphertext...)
 	}
-	userlib.DatastoreSet(newUUID, val)
-
-	return nil
+	return val, nil
 }
 
 // Posts the User struct with username and password to datastore
 func postUser(usr User, username string, password string) (err error) {
 	// variable declarations
 	var usrUUID uuid.UUID
-	var salt, symEnc, symMAC []byte
-
-	// generate and compute necessary values
-	salt = userlib.RandomBytes(40)
-	usrUUID = getUserUUID(username, password)
-	symEnc, symMAC = getUserKeys(username, password, salt)
+	var val []byte
 
-	// post to datastore
-	err = postStruct(usr, usrUUID, symEnc, symMAC, salt, usr, false)
+	// seal and post to datastore
+	usrUUID, val, err = sealUser(usr, username, password)
+	if err != nil {
+		return err
+	}
+	err = usr.backend.Datastore.Set(usrUUID, val)
 	if err != nil {
 		userlib.DebugMsg("error when posting user struct of " + usr.Username)
 		return err
@@ -281,8 +331,30 @@ func postUser(usr User, username string, password string) (err error) {
 	return nil
 }
 
+// Does everything postUser does short of storing the User struct, which it
+// returns instead along with the UUID it belongs at
+func sealUser(usr User, username string, password string) (usrUUID uuid.UUID, val []byte, err error) {
+	// variable declarations
+	var salt, symEnc, symMAC []byte
+
+	// compute necessary values, or reuse the ones cached for this session
+	if usr.session == nil {
+		usr.session = newUserSession(username, password)
+	}
+	usrUUID = usr.session.usrUUID
+	salt, symEnc, symMAC = usr.session.sealKeys(username, password)
+
+	val, err = sealStruct(usr, symEnc, symMAC, salt, usr, false)
+	if err != nil {
+		userlib.DebugMsg("error when sealing user struct of " + usr.Username)
+		return usrUUID, nil, err
+	}
+	return usrUUID, val, nil
+}
+
 // Post the given Metadata struct to datastore
 func postMetadata(usr User, metadata Metadata, metadataKey []byte) (err error) {
+	metadata.Revision++
 	err = postStruct(metadata, metadata.MetadataUUID, metadataKey, nil, nil, usr, true)
 	if err != nil {
 		userlib.DebugMsg("error when posting metadata struct for file")
@@ -293,6 +365,11 @@ func postMetadata(usr User, metadata Metadata, metadataKey []byte) (err error) {
 
 // Post the given Text struct to datastore
 func postText(usr User, text Text, metadata Metadata) (err error) {
+	text.Data, err = compressData(metadata.Compression, text.Data)
+	if err != nil {
+		userlib.DebugMsg("error compressing text block")
+		return err
+	}
 	err = postStruct(text, text.TextUUID, metadata.TextEncKey, metadata.TextMACKey, nil, usr, false)
 	if err != nil {
 		userlib.DebugMsg("error when posting text struct for file")
@@ -301,51 +378,92 @@ func postText(usr User, text Text, metadata Metadata) (err error) {
 	return nil
 }
 
+// Post the given Sentinel struct to datastore (sentinels are stored unencrypted; only the lock is signed)
+func postSentinel(usr User, sentinel Sentinel, sentinelUUID uuid.UUID) (err error) {
+	var plaintext []byte
+
+	plaintext, err = json.Marshal(sentinel)
+	if err != nil {
+		userlib.DebugMsg("error marshalling file sentinel")
+		return err
+	}
+	err = usr.backend.Datastore.Set(sentinelUUID, plaintext)
+	if err != nil {
+		userlib.DebugMsg("error posting file sentinel")
+		return err
+	}
+	return nil
+}
+
+// Retrieve the Sentinel struct at the given UUID from datastore
+func getSentinel(usr User, sentinelUUID uuid.UUID) (sentinel Sentinel, err error) {
+	var plaintext []byte
+	var ok bool
+
+	plaintext, ok = usr.backend.Datastore.Get(sentinelUUID)
+	if !ok {
+		userlib.DebugMsg("file sentinel is not at recorded UUID")
+		return sentinel, errors.New(strings.ToTitle("file sentinel is not at recorded UUID"))
+	}
+	err = json.Unmarshal(plaintext, &sentinel)
+	if err != nil {
+		userlib.DebugMsg("error unmarshalling file sentinel")
+		return sentinel, err
+	}
+	return sentinel, nil
+}
+
+// Delete the given Text blocks from datastore
+func deleteText(usr User, textList []uuid.UUID) (err error) {
+	for _, textUUID := range textList {
+		err = usr.backend.Datastore.Delete(textUUID)
+		if err != nil {
+			userlib.DebugMsg("error deleting text block")
+			return err
+		}
+	}
+	return nil
+}
+
 // Verifies that the given User has access to the file with the given filename
-func verifyFileAccessHelper(usr User, filenameHash string) (metadata Metadata, metadataKey []byte, err error) {
+func verifyFileAccessHelper(usr User, filenameHash string) (metadata Metadata, metadataKey []byte, raw []byte, err error) {
 	// variable declarations
 	var ok bool
 	var sentinel Sentinel
-	var ownerDSPub, lastModDSPub userlib.DSVerifyKey
+	var ownerDSPub userlib.DSVerifyKey
 	var sentinelUUID, metadataUUID uuid.UUID
-	var plaintext, ciphertext, sig, val []byte
+	var ciphertext, val []byte
 
 	// make sure that filenameHash is in usr.UUIDMap
 	sentinelUUID, ok = usr.UUIDMap[filenameHash]
 	if !ok {
 		userlib.DebugMsg("cannot find UUID of file sentinel!")
-		return metadata, nil, errors.New(strings.ToTitle("user cannot find UUID of file sentinel!"))
+		return metadata, nil, nil, errors.New(strings.ToTitle("user cannot find UUID of file sentinel!"))
 	}
 
 	// make sure owner has a posted DS public key
-	ownerDSPub, ok = userlib.KeystoreGet(usr.OwnerMap[filenameHash] + "-DSVerifyKey")
+	ownerDSPub, ok = usr.backend.Keystore.Get(usr.OwnerMap[filenameHash] + "-DSVerifyKey")
 	if !ok {
 		userlib.DebugMsg(usr.OwnerMap[filenameHash] + " does not have a posted DS Verify Key!")
-		return metadata, nil, errors.New(strings.ToTitle("cannot find file owner's DS Verify key!"))
+		return metadata, nil, nil, errors.New(strings.ToTitle("cannot find file owner's DS Verify key!"))
 	}
 
 	// retrieve the file sentinel
-	plaintext, ok = userlib.DatastoreGet(sentinelUUID)
-	if !ok {
-		userlib.DebugMsg("file sentinel is not at recorded UUID")
-		return metadata, nil, errors.New(strings.ToTitle("file sentinel is not at recorded UUID"))
-	}
-	err = json.Unmarshal(plaintext, &sentinel)
+	sentinel, err = getSentinel(usr, sentinelUUID)
 	if err != nil {
-		userlib.DebugMsg("error unmarshalling file sentinel")
-		return metadata, nil, err
+		return metadata, nil, nil, err
 	}
 
 	// get and decrypt the file metadata key
 	ciphertext, ok = sentinel.MetadataKeyMap[usr.Username]
 	if !ok {
 		userlib.DebugMsg("no encrypted key entry in file sentinel for this user")
-		return metadata, nil, errors.New(strings.ToTitle("no ecnrypted key entry in file sentinel for this user"))
+		return metadata, nil, nil, errors.New(strings.ToTitle("no ecnrypted key entry in file sentinel for this user"))
 	}
 	metadataKey, err = userlib.PKEDec(usr.PKEDec, ciphertext)
 	if err != nil {
 		userlib.DebugMsg("error decrypting key entry in file sentinel for this user")
-		return metadata, nil, err
+		return metadata, nil, nil, err
 	}
 
 	// verify the file sentinel lock
@@ -353,16 +471,33 @@ func verifyFileAccessHelper(usr User, filenameHash string) (metadata Metadata, m
 	val = getSentinelLockVal(metadataUUID, metadataKey)
 	if err != nil {
 		userlib.DebugMsg("error computing sentinel lock value")
-		return metadata, nil, err
+		return metadata, nil, nil, err
 	}
 	err = userlib.DSVerify(ownerDSPub, val, sentinel.Lock)
 	if err != nil {
 		userlib.DebugMsg("could not verify file sentinel lock; data is corrupted!")
-		return metadata, nil, err
+		return metadata, nil, nil, err
 	}
 
+	// retrieve, decrypt and verify the file metadata
+	metadata, val, err = getMetadata(usr, metadataUUID, metadataKey)
+	if err != nil {
+		return metadata, nil, nil, err
+	}
+
+	return metadata, metadataKey, val, nil
+}
+
+// Retrieves, decrypts and verifies the Metadata record at metadataUUID under
+// metadataKey. Also returns the record exactly as it was read.
+func getMetadata(usr User, metadataUUID uuid.UUID, metadataKey []byte) (metadata Metadata, raw []byte, err error) {
+	// variable declarations
+	var ok bool
+	var lastModDSPub userlib.DSVerifyKey
+	var plaintext, ciphertext, sig, val []byte
+
 	// get and split file metadata into components
-	val, ok = userlib.DatastoreGet(metadataUUID)
+	val, ok = usr.backend.Datastore.Get(metadataUUID)
 	if !ok {
 		userlib.DebugMsg("file metadata is not at recorded UUID")
 		return metadata, nil, errors.New(strings.ToTitle("file metadata is not at recorded UUID"))
@@ -386,7 +521,7 @@ func verifyFileAccessHelper(usr User, filenameHash string) (metadata Metadata, m
 		userlib.DebugMsg("error unmarshalling file metadata")
 		return metadata, nil, err
 	}
-	lastModDSPub, ok = userlib.KeystoreGet(metadata.LastModified + "-DSVerifyKey")
+	lastModDSPub, ok = usr.backend.Keystore.Get(metadata.LastModified + "-DSVerifyKey")
 	if !ok {
 		userlib.DebugMsg(metadata.LastModified + " does not have a posted DS Verify Key!")
 		return metadata, nil, errors.New(strings.ToTitle("cannot find last modified's DS Verify key!"))
@@ -401,20 +536,110 @@ func verifyFileAccessHelper(usr User, filenameHash string) (metadata Metadata, m
 		return metadata, nil, errors.New(strings.ToTitle("metadata UUID's do not match!"))
 	}
 
-	return metadata, metadataKey, nil
+	return metadata, val, nil
 }
 
-// Calls the helper to run through checks; on failure, deletes entries in UUIDMap and OwnerMap
+// Calls the helper to run through checks; on failure, deletes entries in UUIDMap, OwnerMap and NameMap
 // On success, returns metadata and metadata key
 func verifyFileAccess(usr User, filenameHash string) (metadata Metadata, metadataKey []byte, err error) {
-	metadata, metadataKey, err = verifyFileAccessHelper(usr, filenameHash)
+	metadata, metadataKey, _, err = verifyFileAccessRaw(usr, filenameHash)
+	return metadata, metadataKey, err
+}
+
+// Same as verifyFileAccess, but also returns the Metadata record exactly as
+// it was read from the datastore, for a later compare-and-set. Metadata
+// older than what usr's session has already read is rejected as replayed.
+func verifyFileAccessRaw(usr User, filenameHash string) (metadata Metadata, metadataKey []byte, raw []byte, err error) {
+	metadata, metadataKey, raw, err = verifyFileAccessHelper(usr, filenameHash)
+	if err != nil {
+		// the owner may have been interrupted between re-keying Metadata and the Sentinel
+		if recovered, _ := recoverRevocation(usr, filenameHash, false); recovered {
+			metadata, metadataKey, raw, err = verifyFileAccessHelper(usr, filenameHash)
+		}
+	}
+	if err == nil && !usr.session.sawRevision(metadata.MetadataUUID, metadata.Revision) {
+		userlib.DebugMsg("file metadata revision went backwards; record was replayed")
+		err = errors.New(strings.ToTitle("file metadata was rolled back"))
+	}
+	if err == nil {
+		_, err = followAppends(usr, &metadata, metadataKey)
+	}
+	if err == nil && !usr.session.sawAppends(appendLogID(metadata), metadata.AppendsFolded) {
+		userlib.DebugMsg("file append log got shorter; records were deleted")
+		err = errors.New(strings.ToTitle("file append log was truncated"))
+	}
 	if err != nil {
 		delete(usr.UUIDMap, filenameHash)
 		delete(usr.OwnerMap, filenameHash)
+		delete(usr.NameMap, filenameHash)
 		userlib.DebugMsg("could not verify that " + usr.Username + " has access to file")
-		return metadata, nil, errors.New(strings.ToTitle("could not verify that user has access to file"))
+		return metadata, nil, nil, errors.New(strings.ToTitle("could not verify that user has access to file"))
+	}
+	return metadata, metadataKey, raw, nil
+}
+
+// Retrieves, verifies, decrypts and unmarshals the Text block at textUUID of the file described by metadata
+func getText(usr User, metadata Metadata, textUUID uuid.UUID) (text Text, err error) {
+	// variable declarations
+	var ok bool
+	var val []byte
+
+	// retrieve from datastore
+	val, ok = usr.backend.Datastore.Get(textUUID)
+	if !ok {
+		userlib.DebugMsg("text block is not at recorded UUID")
+		return text, errors.New(strings.ToTitle("text block is not at recorded UUID"))
 	}
-	return metadata, metadataKey, nil
+	return openText(metadata, textUUID, val)
+}
+
+// Verifies, decrypts and unmarshals val, the record at textUUID, as a Text
+// block of the file described by metadata
+func openText(metadata Metadata, textUUID uuid.UUID, val []byte) (text Text, err error) {
+	// variable declarations
+	var plaintext, ciphertext, authStore, authCompute []byte
+
+	// split val into components
+	if len(val) < userlib.HashSize {
+		userlib.DebugMsg("text block was corrupted in datastore (not enough info)")
+		return text, errors.New(strings.ToTitle("text block was corrupted in datastore (not enough info)"))
+	}
+	authStore = val[:userlib.HashSize]
+	ciphertext = val[userlib.HashSize:]
+
+	// verify, decrypt, and unmarshal text block
+	authCompute, err = userlib.HMACEval(metadata.TextMACKey, ciphertext)
+	if err != nil {
+		userlib.DebugMsg("error computing HMAC of ciphertext for text block")
+		return text, err
+	}
+	if !userlib.HMACEqual(authStore, authCompute) {
+		userlib.DebugMsg("cannot verify text block")
+		return text, errors.New(strings.ToTitle("cannot verify text block"))
+	}
+	if len(ciphertext)%userlib.AESBlockSize != 0 || len(ciphertext) < 2*userlib.AESBlockSize {
+		userlib.DebugMsg("ciphertext is not a multiple of the block size!")
+		return text, errors.New(strings.ToTitle("ciphertext is not a multiple of the block size!"))
+	}
+	plaintext = userlib.SymDec(metadata.TextEncKey, ciphertext)
+	plaintext = unpad(plaintext)
+	err = unmarshalText(plaintext, &text)
+	if err != nil {
+		userlib.DebugMsg("error unmarshalling text block")
+		return text, err
+	}
+	if textUUID != text.TextUUID {
+		userlib.DebugMsg("malicious user swapped text blocks!")
+		return text, errors.New(strings.ToTitle("malicious user swapped text blocks!"))
+	}
+	if metadata.Compression != CompressionNone {
+		text.Data, err = decompressData(metadata.Compression, text.Data, recordedLength(metadata, textUUID))
+	}
+	if err != nil {
+		userlib.DebugMsg("error decompressing text block")
+		return text, err
+	}
+	return text, nil
 }
 
 // **************************************** API FUNCTIONS ******************************** //
@@ -435,6 +660,13 @@ func verifyFileAccess(usr User, filenameHash string) (metadata Metadata, metadat
 // the attackers may possess a precomputed tables containing
 // hashes of common passwords downloaded from the internet.
 func InitUser(username string, password string) (userdataptr *User, err error) {
+	return InitUserWithBackend(Backend{}, username, password)
+}
+
+// Same as InitUser, but binds the new User to the given backend instead of
+// the process-global userlib stores. Every later call on the returned User
+// reads and writes through that backend.
+func InitUserWithBackend(backend Backend, username string, password string) (userdataptr *User, err error) {
 	// variable declarations
 	var usr User
 	var ok bool
@@ -444,12 +676,13 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 	var PKEPub userlib.PKEEncKey
 
 	// check if username has been taken in keystore
-	_, ok = userlib.KeystoreGet(username + "-DSVerifyKey")
+	backend = backend.withDefaults()
+	_, ok = backend.Keystore.Get(username + "-DSVerifyKey")
 	if ok {
 		userlib.DebugMsg("user " + username + " already exists!")
 		return nil, errors.New(strings.ToTitle("user already exists!"))
 	}
-	_, ok = userlib.KeystoreGet(username + "-PKEEncKey")
+	_, ok = backend.Keystore.Get(username + "-PKEEncKey")
 	if ok {
 		userlib.DebugMsg("user " + username + " already exists!")
 		return nil, errors.New(strings.ToTitle("user already exists!"))
@@ -461,7 +694,7 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 		userlib.DebugMsg("error when generating DS key for " + username)
 		return nil, err
 	}
-	err = userlib.KeystoreSet(username+"-DSVerifyKey", DSPub)
+	err = backend.Keystore.Set(username+"-DSVerifyKey", DSPub)
 	if err != nil {
 		userlib.DebugMsg("error when setting DS Pub key of " + username + " to Keystore")
 		return nil, err
@@ -474,7 +707,7 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 		userlib.DebugMsg("error when generating PKE key for " + username)
 		return nil, err
 	}
-	err = userlib.KeystoreSet(username+"-PKEEncKey", PKEPub)
+	err = backend.Keystore.Set(username+"-PKEEncKey", PKEPub)
 	if err != nil {
 		userlib.DebugMsg("error when setting PKE Enc key of " + username + " to Keystore")
 		return nil, err
@@ -484,8 +717,11 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 	// fill out remaining fields in usr
 	usr.UUIDMap = make(map[string]uuid.UUID)
 	usr.OwnerMap = make(map[string]string)
+	usr.NameMap = make(map[string]string)
 	usr.Username = username
 	usr.password = password
+	usr.backend = backend
+	usr.session = newUserSession(username, password)
 
 	// post usr to datastore
 	err = postUser(usr, username, password)
@@ -501,6 +737,20 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 // fail with an error if the user/password is invalid, or if the user
 // data was corrupted, or if the user can't be found.
 func GetUser(username string, password string) (userdataptr *User, err error) {
+	return GetUserWithBackend(Backend{}, username, password)
+}
+
+// Same as GetUser, but fetches the user from the given backend and binds
+// the returned User to it.
+func GetUserWithBackend(backend Backend, username string, password string) (userdataptr *User, err error) {
+	userdataptr, _, err = getUserRaw(backend, username, password, nil)
+	return userdataptr, err
+}
+
+// Same as GetUserWithBackend, but also returns the User record exactly as it
+// was read from the datastore, for a later compare-and-set. Derives keys
+// through session if it is not nil, or starts a new session otherwise.
+func getUserRaw(backend Backend, username string, password string, session *userSession) (userdataptr *User, raw []byte, err error) {
 	// variable declarations
 	var usr User
 	var ok bool
@@ -508,69 +758,80 @@ func GetUser(username string, password string) (userdataptr *User, err error) {
 	var salt, symEnc, symMAC, plaintext, ciphertext, authStore, authCompute, val []byte
 
 	// check if this user has keys in keystore
-	_, ok = userlib.KeystoreGet(username + "-DSVerifyKey")
+	backend = backend.withDefaults()
+	_, ok = backend.Keystore.Get(username + "-DSVerifyKey")
 	if !ok {
 		userlib.DebugMsg(username + " does not exist! Could not find associated DS key")
-		return nil, errors.New(strings.ToTitle("user does not exist!"))
+		return nil, nil, errors.New(strings.ToTitle("user does not exist!"))
 	}
-	_, ok = userlib.KeystoreGet(username + "-PKEEncKey")
+	_, ok = backend.Keystore.Get(username + "-PKEEncKey")
 	if !ok {
 		userlib.DebugMsg(username + "does not exist! Could not find associated PKE Enc key")
-		return nil, errors.New(strings.ToTitle("user does not exist!"))
+		return nil, nil, errors.New(strings.ToTitle("user does not exist!"))
 	}
 
 	// check that UUID (as a function of username and password) exists in datastore
-	usrUUID = getUserUUID(username, password)
-	val, ok = userlib.DatastoreGet(usrUUID)
+	if session == nil {
+		session = newUserSession(username, password)
+	}
+	usrUUID = session.usrUUID
+	val, ok = backend.Datastore.Get(usrUUID)
 	if !ok {
 		userlib.DebugMsg("Incorrect password " + password + " or data corrupted")
-		return nil, errors.New(strings.ToTitle("incorrect password or data corrupted"))
+		return nil, nil, errors.New(strings.ToTitle("incorrect password or data corrupted"))
 	}
 
 	// split val into its component parts
 	if len(val) < userlib.HashSize+40 {
 		userlib.DebugMsg("value for user struct was corrupted in DataStore (not enough info)")
-		return nil, errors.New(strings.ToTitle("value for user struct was corrupted in DataStore (not enough info)"))
+		return nil, nil, errors.New(strings.ToTitle("value for user struct was corrupted in DataStore (not enough info)"))
 	}
 	authStore = val[:userlib.HashSize]
 	salt = val[userlib.HashSize : userlib.HashSize+40]
 	ciphertext = val[userlib.HashSize+40:]
 
 	// compute symmetric keys based on username, salt for encryption, authentication
-	symEnc, symMAC = getUserKeys(username, password, salt)
+	symEnc, symMAC = session.keys(username, password, salt)
 
 	// verify, decrypt, and unmarshal val
 	authCompute, err = userlib.HMACEval(symMAC, ciphertext)
 	if err != nil {
 		userlib.DebugMsg("error computing HMAC of ciphertext for " + username)
-		return nil, err
+		return nil, nil, err
 	}
 	if !userlib.HMACEqual(authStore, authCompute) {
 		userlib.DebugMsg("cannot verify User struct for " + username)
-		return nil, errors.New(strings.ToTitle("cannot verify User struct"))
+		return nil, nil, errors.New(strings.ToTitle("cannot verify User struct"))
 	}
 	if len(ciphertext)%userlib.AESBlockSize != 0 {
 		userlib.DebugMsg("ciphertext is not a multiple of the block size!")
-		return nil, errors.New(strings.ToTitle("ciphertext is not a multiple of the block size!"))
+		return nil, nil, errors.New(strings.ToTitle("ciphertext is not a multiple of the block size!"))
 	}
 	plaintext = userlib.SymDec(symEnc, ciphertext)
 	plaintext = unpad(plaintext)
 	err = json.Unmarshal(plaintext, &usr)
 	if err != nil {
 		userlib.DebugMsg("error unmarshalling user struct for " + username)
-		return nil, errors.New(strings.ToTitle("cannot unmarshal User struct"))
+		return nil, nil, errors.New(strings.ToTitle("cannot unmarshal User struct"))
 	}
 
 	// check that username matches username provided
 	if usr.Username != username {
 		userlib.DebugMsg("username mismatch, something fishy is going on...")
-		return nil, errors.New(strings.ToTitle("username mismatch"))
+		return nil, nil, errors.New(strings.ToTitle("username mismatch"))
+	}
+
+	// users created before the filename index existed have no NameMap
+	if usr.NameMap == nil {
+		usr.NameMap = make(map[string]string)
 	}
 
-	// fill in private field
+	// fill in private fields
 	usr.password = password
+	usr.backend = backend
+	usr.session = session
 
-	return &usr, nil
+	return &usr, val, nil
 }
 
 // This stores a file in the datastore.
@@ -588,11 +849,13 @@ func (usr *User) StoreFile(filename string, data []byte) {
 	var filenameHash string
 	var ok, isNewFile bool
 	var sentinelUUID, metadataUUID, textUUID uuid.UUID
-	var metadataKey, symEnc, symMAC, plaintext, val []byte
+	var metadataKey, symEnc, symMAC, val []byte
 	var shared []string
+	var superseded []uuid.UUID
+	var replace func(metadata *Metadata) error
 
 	// first, determine if we are storing a completely new file or updating an existing one
-	usr, err = GetUser(usr.Username, usr.password)
+	usr, err = refreshUser(usr)
 	if err != nil {
 		userlib.DebugMsg("Could not update User struct!")
 		return
@@ -609,24 +872,31 @@ func (usr *User) StoreFile(filename string, data []byte) {
 	textUUID = uuid.New()
 	symEnc = userlib.RandomBytes(userlib.AESBlockSize)
 	symMAC = userlib.RandomBytes(userlib.AESBlockSize)
-	PKEPub, ok = userlib.KeystoreGet(usr.Username + "-PKEEncKey")
+	PKEPub, ok = usr.backend.Keystore.Get(usr.Username + "-PKEEncKey")
 	if !ok {
 		userlib.DebugMsg(usr.Username + " does not have a PKE Public Key in Keystore!")
 		return
 	}
 
+	// the update that makes data the file contents
+	replace = func(metadata *Metadata) error {
+		superseded = recordVersion(metadata)
+		metadata.LastModified = usr.Username
+		markModified(metadata)
+		metadata.TextList = nil
+		metadata.TextLengths = nil
+		appendBlock(metadata, textUUID, len(data))
+		return nil
+	}
+
 	// if new file, create new file sentinel and file metadata
-	// if not new file, retrieve file metadata
+	// if not new file, update file metadata
 	if isNewFile {
 		// generate more values for new files
 		sentinelUUID = uuid.New()
 		metadataUUID = uuid.New()
 		metadataKey = userlib.RandomBytes(userlib.AESBlockSize)
 
-		// update maps in user struct
-		usr.UUIDMap[filenameHash] = sentinelUUID
-		usr.OwnerMap[filenameHash] = usr.Username
-
 		// construct file sentinel
 		sentinel.MetadataKeyMap = make(map[string][]byte)
 		sentinel.MetadataKeyMap[usr.Username], err = userlib.PKEEnc(PKEPub, metadataKey)
@@ -643,51 +913,80 @@ func (usr *User) StoreFile(filename string, data []byte) {
 		sentinel.MetadataUUID = metadataUUID
 
 		// post file sentinel to userdata
-		plaintext, err = json.Marshal(sentinel)
+		err = postSentinel(*usr, sentinel, sentinelUUID)
 		if err != nil {
-			userlib.DebugMsg("error marshalling file sentinel")
 			return
 		}
-		userlib.DatastoreSet(sentinelUUID, plaintext)
 
 		// construct file metadata
 		metadata.MetadataUUID = metadataUUID
 		metadata.Owner = usr.Username
 		metadata.TextEncKey = symEnc
 		metadata.TextMACKey = symMAC
+		metadata.AppendLog = uuid.New()
 		ownerNode.Username = usr.Username
 		metadata.AccessMap = make(map[string][]string)
 		metadata.AccessMap[usr.Username] = shared
-	} else {
-		metadata, metadataKey, err = verifyFileAccess(*usr, filenameHash)
+		replace(&metadata)
+
+		// post file metadata and text block
+		err = postMetadata(*usr, metadata, metadataKey)
 		if err != nil {
-			userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+			userlib.DebugMsg("error posting file metadata")
+			return
+		}
+		text.TextUUID = textUUID
+		text.Data = data
+		err = postText(*usr, text, metadata)
+		if err != nil {
+			userlib.DebugMsg("error posting text block")
 			return
 		}
+
+		// only now make the file reachable, merging with other sessions' changes
+		err = updateUser(usr, func(usr *User) error {
+			if _, ok := usr.UUIDMap[filenameHash]; ok {
+				return errFileExists
+			}
+			usr.UUIDMap[filenameHash] = sentinelUUID
+			usr.OwnerMap[filenameHash] = usr.Username
+			usr.NameMap[filenameHash] = filename
+			return nil
+		})
+		if err == errFileExists {
+			// another session created the file first; overwrite theirs instead
+			usr.backend.Datastore.Delete(sentinelUUID)
+			usr.backend.Datastore.Delete(metadataUUID)
+			deleteText(*usr, metadata.TextList)
+			usr.StoreFile(filename, data)
+			return
+		}
+		if err != nil {
+			userlib.DebugMsg("error posting user struct")
+		}
+		return
 	}
 
-	// update file metadata
-	metadata.LastModified = usr.Username
-	metadata.TextList = nil
-	metadata.TextList = append(metadata.TextList, textUUID)
+	// replace the contents of whatever metadata is current when the swap lands
+	metadata, _, err = updateMetadata(*usr, filenameHash, replace)
+	if err != nil {
+		userlib.DebugMsg("could not update metadata of " + filename + " for " + usr.Username)
+		return
+	}
 
-	// construct text block
+	// construct and post text block
 	text.TextUUID = textUUID
 	text.Data = data
-
-	// post new/updated user struct, file metadata, and text block
-	err = postUser(*usr, usr.Username, usr.password)
-	if err != nil {
-		userlib.DebugMsg("error posting user struct")
-	}
-	err = postMetadata(*usr, metadata, metadataKey)
+	err = postText(*usr, text, metadata)
 	if err != nil {
-		userlib.DebugMsg("error posting file metadata")
+		userlib.DebugMsg("error posting text block")
 		return
 	}
-	err = postText(*usr, text, metadata)
+
+	// the old contents are no longer reachable from metadata unless kept as a version
+	err = releaseText(*usr, metadata, superseded)
 	if err != nil {
-		userlib.DebugMsg("error posting text block")
+		userlib.DebugMsg("error deleting superseded text blocks")
 		return
 	}
 }
@@ -703,38 +1002,50 @@ func (usr *User) AppendFile(filename string, data []byte) (err error) {
 	var text Text
 	var filenameHash string
 	var metadataKey []byte
+	var index, pending int
 
 	// verify that this user has access to the given file
-	usr, err = GetUser(usr.Username, usr.password)
+	usr, err = refreshUser(usr)
 	if err != nil {
 		userlib.DebugMsg("Could not update User struct!")
 		return err
 	}
 	filenameHash = getFilenameHash(filename, usr.Username)
-	metadata, metadataKey, err = verifyFileAccess(*usr, filenameHash)
-	if err != nil {
-		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
-		return errors.New(strings.ToTitle("could not verify that user has access to file"))
-	}
 
 	// construct new text block
 	text.TextUUID = uuid.New()
 	text.Data = data
 
-	// update metadata
-	metadata.LastModified = usr.Username
-	metadata.TextList = append(metadata.TextList, text.TextUUID)
-
-	// post updated file metadata and new text block
-	err = postMetadata(*usr, metadata, metadataKey)
+	// post the block, then claim the next append log slot for it; only the
+	// stored Metadata is read, never re-posted, and the log is not followed
+	err = retryOnConflict(func() (err error) {
+		metadata, metadataKey, _, err = verifyFileAccessHelper(*usr, filenameHash)
+		if err != nil {
+			userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+			return errors.New(strings.ToTitle("could not verify that user has access to file"))
+		}
+		err = postText(*usr, text, metadata)
+		if err != nil {
+			userlib.DebugMsg("error posting text block")
+			return err
+		}
+		index, err = postAppendRecord(*usr, metadata, metadataKey, newAppendRecord(*usr, metadata, text.TextUUID, len(data)))
+		if err != nil {
+			deleteText(*usr, []uuid.UUID{text.TextUUID})
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		userlib.DebugMsg("error posting file metadata")
 		return err
 	}
-	err = postText(*usr, text, metadata)
-	if err != nil {
-		userlib.DebugMsg("error posting text block")
-		return err
+
+	// the append has landed; a failed compaction only leaves the file fragmented
+	pending = index + 1 - metadata.AppendsFolded
+	if metadata.CompactThreshold > 0 && len(metadata.TextList)+pending > metadata.CompactThreshold && worthCompacting(*usr, metadata, metadataKey) {
+		if usr.CompactFile(filename, metadata.CompactBlockSize) != nil {
+			userlib.DebugMsg("automatic compaction of " + filename + " failed")
+		}
 	}
 
 	return nil
@@ -746,13 +1057,11 @@ func (usr *User) AppendFile(filename string, data []byte) (err error) {
 func (usr *User) LoadFile(filename string) (data []byte, err error) {
 	// variable declarations
 	var metadata Metadata
-	var text Text
-	var ok bool
+	var texts []Text
 	var filenameHash string
-	var plaintext, ciphertext, authStore, authCompute, val []byte
 
 	// verify that this user has access to the given file
-	usr, err = GetUser(usr.Username, usr.password)
+	usr, err = refreshUser(usr)
 	if err != nil {
 		userlib.DebugMsg("Could not update User struct!")
 		return nil, err
@@ -764,49 +1073,16 @@ func (usr *User) LoadFile(filename string) (data []byte, err error) {
 		return nil, errors.New(strings.ToTitle("could not verify that user has access to filename"))
 	}
 
-	// for each text block in metadata.TextList
-	for i := range metadata.TextList {
-		// retrieve from datastore and split val into components
-		val, ok = userlib.DatastoreGet(metadata.TextList[i])
-		if !ok {
-			userlib.DebugMsg("text block is not at recorded UUID")
-			return nil, errors.New(strings.ToTitle("text block is not at recorded UUID"))
-		}
-		if len(val) < userlib.HashSize {
-			userlib.DebugMsg("text block was corrupted in datastore (not enough info)")
-			return nil, errors.New(strings.ToTitle("text block was corrupted in datastore (not enough info)"))
-		}
-		authStore = val[:userlib.HashSize]
-		ciphertext = val[userlib.HashSize:]
-
-		// verify, decrypt, and unmarshal text block
-		authCompute, err = userlib.HMACEval(metadata.TextMACKey, ciphertext)
-		if err != nil {
-			userlib.DebugMsg("error computing HMAC of ciphertext for text block")
-			return nil, err
-		}
-		if !userlib.HMACEqual(authStore, authCompute) {
-			userlib.DebugMsg("cannot verify text block for " + filename)
-			return nil, errors.New(strings.ToTitle("cannot verify text block"))
-		}
-		if len(ciphertext)%userlib.AESBlockSize != 0 {
-			userlib.DebugMsg("ciphertext is not a multiple of the block size!")
-			return nil, errors.New(strings.ToTitle("ciphertext is not a multiple of the block size!"))
-		}
-		plaintext = userlib.SymDec(metadata.TextEncKey, ciphertext)
-		plaintext = unpad(plaintext)
-		err = json.Unmarshal(plaintext, &text)
-		if err != nil {
-			userlib.DebugMsg("error unmarshalling text block")
-			return nil, err
-		}
-		if metadata.TextList[i] != text.TextUUID {
-			userlib.DebugMsg("malicious user swapped text blocks!")
-			return nil, errors.New(strings.ToTitle("malicious user swapped text blocks!"))
-		}
+	// fetch every text block in metadata.TextList, several at a time
+	texts, err = getTexts(*usr, metadata, metadata.TextList)
+	if err != nil {
+		userlib.DebugMsg("cannot load text block for " + filename)
+		return nil, err
+	}
 
-		// concatenate data in this text block to data
-		data = append(data, text.Data...)
+	// concatenate data in each text block to data, in order
+	for i := range texts {
+		data = append(data, texts[i].Data...)
 	}
 
 	return data, nil
@@ -830,74 +1106,59 @@ func (userdata *User) ShareFile(filename string, recipient string) (
 	var ok bool
 	var filenameHash, signatureString string
 	var recipientPKEEnc userlib.PKEEncKey
-	var sentinel Sentinel
 	var sentinelUUID uuid.UUID
-	var metadataKey, symEnc, signature, plaintext, magicStringPlaintext, magicStringCombined, ciphertext, key []byte
+	var metadataKey, symEnc, signature, magicStringPlaintext, magicStringCombined, ciphertext, key []byte
 	var magicStringStruc magicStringStruct
 	var share []string
 
-	userdata, err = GetUser(userdata.Username, userdata.password)
+	userdata, err = refreshUser(userdata)
 	if err != nil {
 		userlib.DebugMsg("Could not update User struct!")
 		return "", err
 	}
-	// verify user has access to given file
-	filenameHash = getFilenameHash(filename, userdata.Username)
-	metadata, metadataKey, err = verifyFileAccess(*userdata, filenameHash)
-	if err != nil {
-		userlib.DebugMsg("could not verify that " + userdata.Username + " has access to " + filename)
-		return "", errors.New(strings.ToTitle("could not verify that user has access to file"))
-	}
-
 	// check that recipient is valid
-	recipientPKEEnc, ok = userlib.KeystoreGet(recipient + "-PKEEncKey")
+	recipientPKEEnc, ok = userdata.backend.Keystore.Get(recipient + "-PKEEncKey")
 	if !ok {
 		userlib.DebugMsg(recipient + " does not exist! Could not find associated PKE Encryption Key")
 		return "", errors.New(strings.ToTitle("recipient does not exist!"))
 	}
 
-	// update AccessTree, AccessList, and last modified
-	metadata.AccessMap[userdata.Username] = append(metadata.AccessMap[userdata.Username], recipient)
-	metadata.AccessMap[recipient] = share
-	metadata.LastModified = userdata.Username
-
-	// post metadata
-	err = postMetadata(*userdata, metadata, metadataKey)
-	if err != nil {
-		userlib.DebugMsg("error posting file metadata")
+	// verify user has access to given file, then update AccessTree, AccessList,
+	// and last modified on whatever metadata is current when the swap lands
+	filenameHash = getFilenameHash(filename, userdata.Username)
+	metadata, metadataKey, err = updateMetadata(*userdata, filenameHash, func(metadata *Metadata) error {
+		metadata.AccessMap[userdata.Username] = append(metadata.AccessMap[userdata.Username], recipient)
+		metadata.AccessMap[recipient] = share
+		metadata.LastModified = userdata.Username
+		return nil
+	})
+	if err == errMetadataConflict {
+		userlib.DebugMsg("could not share " + filename + " after repeated conflicts")
 		return "", err
 	}
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + userdata.Username + " has access to " + filename)
+		return "", errors.New(strings.ToTitle("could not verify that user has access to file"))
+	}
 
 	// update file sentinel
-	filenameHash = getFilenameHash(filename, userdata.Username)
 	sentinelUUID, ok = userdata.UUIDMap[filenameHash]
 	if !ok {
 		userlib.DebugMsg("cannot find UUID of file sentinel!")
 		return "", errors.New(strings.ToTitle("user cannot find UUID of file sentinel!"))
 	}
-	plaintext, ok = userlib.DatastoreGet(sentinelUUID)
-	if !ok {
-		userlib.DebugMsg("file sentinel is not at recorded UUID")
-		return "", errors.New(strings.ToTitle("file sentinel is not at recorded UUID"))
-	}
-	err = json.Unmarshal(plaintext, &sentinel)
-	if err != nil {
-		userlib.DebugMsg("error unmarshalling file sentinel")
-		return "", err
-	}
-	sentinel.MetadataKeyMap[recipient], err = userlib.PKEEnc(recipientPKEEnc, metadataKey)
+	key, err = userlib.PKEEnc(recipientPKEEnc, metadataKey)
 	if err != nil {
 		userlib.DebugMsg("error RSA-encrypting file metadata key")
 		return "", err
 	}
-
-	// post file sentinel to userdata
-	plaintext, err = json.Marshal(sentinel)
+	err = updateSentinel(*userdata, sentinelUUID, func(sentinel *Sentinel) error {
+		sentinel.MetadataKeyMap[recipient] = key
+		return nil
+	})
 	if err != nil {
-		userlib.DebugMsg("error marshalling file sentinel")
 		return "", err
 	}
-	userlib.DatastoreSet(sentinelUUID, plaintext)
 
 	// generate magic string
 	magicStringStruc.Owner = metadata.Owner
@@ -943,14 +1204,14 @@ func (userdata *User) ReceiveFile(filename string, sender string,
 	var owner, filenameHash string
 
 	// get updated user
-	userdata, err = GetUser(userdata.Username, userdata.password)
+	userdata, err = refreshUser(userdata)
 	if err != nil {
 		userlib.DebugMsg("Could not update User struct!")
 		return err
 	}
 
 	// verify DS
-	senderDSPub, ok = userlib.KeystoreGet(sender + "-DSVerifyKey")
+	senderDSPub, ok = userdata.backend.Keystore.Get(sender + "-DSVerifyKey")
 	if !ok {
 		userlib.DebugMsg("Error retrieving sender DSVerifyKey")
 		return errors.New(strings.ToTitle("Could not retrieve sender DSVerify Key!"))
@@ -993,20 +1254,27 @@ func (userdata *User) ReceiveFile(filename string, sender string,
 	filenameHash = getFilenameHash(filename, userdata.Username)
 	if _, ok := userdata.UUIDMap[filenameHash]; ok {
 		userlib.DebugMsg("File exists in user struct")
-		return errors.New(strings.ToTitle("There is already a file with this name!"))
+		return errFileExists
 	}
 
 	// verify owner is a valid user in Keystore
-	_, ok = userlib.KeystoreGet(owner + "-PKEEncKey")
+	_, ok = userdata.backend.Keystore.Get(owner + "-PKEEncKey")
 	if !ok {
 		userlib.DebugMsg(owner + " does not exist! Could not find associated PKE Encryption Key")
 		return errors.New(strings.ToTitle("Owner does not exist!"))
 	}
 
-	// modify userdata and save
-	userdata.UUIDMap[filenameHash] = sentinelUUID
-	userdata.OwnerMap[filenameHash] = owner
-	err = postUser(*userdata, userdata.Username, userdata.password)
+	// modify userdata and save, merging with other sessions' changes
+	err = updateUser(userdata, func(usr *User) error {
+		if _, ok := usr.UUIDMap[filenameHash]; ok {
+			userlib.DebugMsg("File exists in user struct")
+			return errFileExists
+		}
+		usr.UUIDMap[filenameHash] = sentinelUUID
+		usr.OwnerMap[filenameHash] = owner
+		usr.NameMap[filenameHash] = filename
+		return nil
+	})
 	if err != nil {
 		userlib.DebugMsg("error posting user struct")
 		return err
@@ -1015,158 +1283,105 @@ func (userdata *User) ReceiveFile(filename string, sender string,
 }
 
 // Removes target user's access.
+//
+// Every Text block is copied under new keys before the file switches over,
+// so a failure part way leaves the file as it was. A revocation of the same
+// file that was interrupted is finished or undone first.
 func (userdata *User) RevokeFile(filename string, target_username string) (err error) {
 	// variable declarations
 	var filenameHash string
 	var metadata Metadata
 	var ok bool
-	var newMetadataKey, newTextHMAC, newTextSymEnc, authStore, ciphertext, plaintext, authCompute, val []byte
-	var text Text
+	var metadataKey, raw, posted []byte
+	var journal RevokeJournal
 	var sentinelUUID uuid.UUID
-	var sentinel Sentinel
-	var nodePKEEnc userlib.PKEEncKey
 
-	userdata, err = GetUser(userdata.Username, userdata.password)
+	userdata, err = refreshUser(userdata)
 	if err != nil {
 		userlib.DebugMsg("Could not update User struct!")
 		return err
 	}
-	// verify user has access to file and is owner
 	filenameHash = getFilenameHash(filename, userdata.Username)
-	metadata, _, err = verifyFileAccess(*userdata, filenameHash)
-	if err != nil {
-		userlib.DebugMsg("could not verify that " + userdata.Username + " has access to " + filename)
-		return errors.New(strings.ToTitle("could not verify that user has access to file"))
-	}
-	if metadata.Owner != userdata.Username {
-		userlib.DebugMsg("User is not owner of the file")
-		return errors.New(strings.ToTitle("User is not owner of file!"))
-	}
-
-	// verify target is valid and remove
-	ok = accessContains(metadata.AccessMap, target_username)
-	if !ok {
-		userlib.DebugMsg("Target not in metadata accessList")
-		return errors.New(strings.ToTitle("Target does not have access to the file!"))
-	}
-	ok = shared(userdata.Username, target_username, metadata.AccessMap)
+	sentinelUUID, ok = userdata.UUIDMap[filenameHash]
 	if !ok {
-		userlib.DebugMsg("Owner did not share to target")
-		return errors.New(strings.ToTitle("Owner did not share to target!"))
+		userlib.DebugMsg("cannot find UUID of file sentinel!")
+		return errors.New(strings.ToTitle("user cannot find UUID of file sentinel!"))
 	}
 
-	metadata.AccessMap, err = removeAccess(metadata.AccessMap, userdata.Username, target_username)
+	// finish or undo an earlier revocation of this file that was interrupted
+	_, err = recoverRevocation(*userdata, filenameHash, true)
 	if err != nil {
+		userlib.DebugMsg("could not recover interrupted revocation of " + filename)
 		return err
 	}
 
-	// recompute metadata key, textblock key, textblock HMAC key
-	newMetadataKey = userlib.RandomBytes(userlib.AESBlockSize)
-	newTextSymEnc = userlib.RandomBytes(userlib.AESBlockSize)
-	newTextHMAC = userlib.RandomBytes(userlib.AESBlockSize)
+	return retryOnConflict(func() (err error) {
+		// verify user has access to file and is owner
+		metadata, metadataKey, raw, err = verifyFileAccessRaw(*userdata, filenameHash)
+		if err != nil {
+			userlib.DebugMsg("could not verify that " + userdata.Username + " has access to " + filename)
+			return errors.New(strings.ToTitle("could not verify that user has access to file"))
+		}
+		if metadata.Owner != userdata.Username {
+			userlib.DebugMsg("User is not owner of the file")
+			return errors.New(strings.ToTitle("User is not owner of file!"))
+		}
 
-	// reencrypt textblocks
-	for i := range metadata.TextList {
-		// retrieve from datastore and split val into components
-		val, ok = userlib.DatastoreGet(metadata.TextList[i])
+		// verify target is valid and remove
+		ok = accessContains(metadata.AccessMap, target_username)
 		if !ok {
-			userlib.DebugMsg("text block is not at recorded UUID")
-			return errors.New(strings.ToTitle("text block is not at recorded UUID"))
+			userlib.DebugMsg("Target not in metadata accessList")
+			return errors.New(strings.ToTitle("Target does not have access to the file!"))
 		}
-		if len(val) < userlib.HashSize {
-			userlib.DebugMsg("text block value was corrupted in datastore (not enough info)")
-			return errors.New(strings.ToTitle("text block value was corrupted in datastore (not enough info)"))
+		ok = shared(userdata.Username, target_username, metadata.AccessMap)
+		if !ok {
+			userlib.DebugMsg("Owner did not share to target")
+			return errors.New(strings.ToTitle("Owner did not share to target!"))
 		}
-		authStore = val[:userlib.HashSize]
-		ciphertext = val[userlib.HashSize:]
 
-		// verify, decrypt, and unmarshal text block
-		authCompute, err = userlib.HMACEval(metadata.TextMACKey, ciphertext)
+		metadata.AccessMap, err = removeAccess(metadata.AccessMap, userdata.Username, target_username)
 		if err != nil {
-			userlib.DebugMsg("error computing HMAC of ciphertext for text block")
 			return err
 		}
-		if !userlib.HMACEqual(authStore, authCompute) {
-			userlib.DebugMsg("cannot verify text block for " + filename)
-			return errors.New(strings.ToTitle("cannot verify text block"))
-		}
-		if len(ciphertext)%userlib.AESBlockSize != 0 {
-			userlib.DebugMsg("ciphertext is not a multiple of the block size!")
-			return errors.New(strings.ToTitle("ciphertext is not a multiple of the block size!"))
+
+		// recompute metadata key, textblock key, textblock HMAC key, and
+		// journal them before anything is re-keyed
+		journal = RevokeJournal{
+			MetadataUUID: metadata.MetadataUUID,
+			Target:       target_username,
+			MetadataKey:  userlib.RandomBytes(userlib.AESBlockSize),
+			TextEncKey:   userlib.RandomBytes(userlib.AESBlockSize),
+			TextMACKey:   userlib.RandomBytes(userlib.AESBlockSize),
+			OldLock:      getSentinelLockVal(metadata.MetadataUUID, metadataKey),
+			Revision:     metadata.Revision,
 		}
-		plaintext = userlib.SymDec(metadata.TextEncKey, ciphertext)
-		plaintext = unpad(plaintext)
-		err = json.Unmarshal(plaintext, &text)
+		posted, err = postRevokeJournal(*userdata, journal, nil)
 		if err != nil {
-			userlib.DebugMsg("error unmarshalling text block")
 			return err
 		}
-		if metadata.TextList[i] != text.TextUUID {
-			userlib.DebugMsg("malicious user swapped text blocks!")
-			return errors.New(strings.ToTitle("malicious user swapped text blocks!"))
-		}
 
-		// post text block
-		err = postStruct(text, text.TextUUID, newTextSymEnc, newTextHMAC, nil, *userdata, false)
-		if err != nil {
-			userlib.DebugMsg("Error reposting text blocks")
+		// copy textblocks under the new keys and post metadata pointing at them;
+		// until that post the old blocks and keys are untouched, so back out on failure
+		err = rekeyFile(*userdata, &metadata, metadataKey, raw, &journal, posted)
+		if err == errRevocationInProgress {
+			// the journal belongs to the other revocation now; leave it be
 			return err
 		}
-	}
-
-	// Update file metadata and post
-	metadata.TextEncKey = newTextSymEnc
-	metadata.TextMACKey = newTextHMAC
-	metadata.LastModified = userdata.Username
-	err = postMetadata(*userdata, metadata, newMetadataKey)
-	if err != nil {
-		userlib.DebugMsg("error posting file metadata")
-		return err
-	}
-
-	// Update file sentinel and post
-	filenameHash = getFilenameHash(filename, userdata.Username)
-	sentinelUUID, ok = userdata.UUIDMap[filenameHash]
-	if !ok {
-		userlib.DebugMsg("cannot find UUID of file sentinel!")
-		return errors.New(strings.ToTitle("user cannot find UUID of file sentinel!"))
-	}
-	plaintext, ok = userlib.DatastoreGet(sentinelUUID)
-	if !ok {
-		userlib.DebugMsg("file sentinel is not at recorded UUID")
-		return errors.New(strings.ToTitle("file sentinel is not at recorded UUID"))
-	}
-	err = json.Unmarshal(plaintext, &sentinel)
-	if err != nil {
-		userlib.DebugMsg("error unmarshalling file sentinel")
-		return err
-	}
-	sentinel.MetadataKeyMap = make(map[string][]byte)
-	for k := range metadata.AccessMap {
-		nodePKEEnc, ok = userlib.KeystoreGet(k + "-PKEEncKey")
-		if !ok {
-			userlib.DebugMsg("Error finding node's PKEEnc Key")
-			return errors.New(strings.ToTitle("Could not compute new PKEs for file sentinel."))
-		}
-		sentinel.MetadataKeyMap[k], err = userlib.PKEEnc(nodePKEEnc, newMetadataKey)
 		if err != nil {
-			userlib.DebugMsg("error RSA-encrypting file metadata key")
+			userlib.DebugMsg("undoing revocation of " + target_username + " from " + filename)
+			undoErr := undoRevocation(*userdata, filenameHash, journal)
+			if undoErr == errRevocationCommitted {
+				// the post landed even though it reported failure
+				_, err = recoverRevocation(*userdata, filenameHash, false)
+				return err
+			}
+			if undoErr != nil {
+				return undoErr
+			}
 			return err
 		}
-	}
-	val = getSentinelLockVal(metadata.MetadataUUID, newMetadataKey)
-	sentinel.Lock, err = userlib.DSSign(userdata.DSSign, val)
-	if err != nil {
-		userlib.DebugMsg("error computing sentinel lock value")
-		return err
-	}
 
-	// post file sentinel to userdata
-	plaintext, err = json.Marshal(sentinel)
-	if err != nil {
-		userlib.DebugMsg("error marshalling file sentinel")
-		return err
-	}
-	userlib.DatastoreSet(sentinelUUID, plaintext)
-	return nil
+		// Update file sentinel and post, then delete the old textblocks
+		return finishRevocation(*userdata, sentinelUUID, metadata, journal)
+	})
 }
@@ -0,0 +1,120 @@
+package proj2
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ***************************************** RANDOM ACCESS ******************************* //
+
+// Appends a block to the end of the file described by metadata, keeping
+// TextLengths in step with TextList. If the lengths were already unknown
+// (the file predates them) they stay unknown.
+func appendBlock(metadata *Metadata, textUUID uuid.UUID, length int) {
+	if len(metadata.TextLengths) == len(metadata.TextList) {
+		metadata.TextLengths = append(metadata.TextLengths, length)
+	} else {
+		metadata.TextLengths = nil
+	}
+	metadata.TextList = append(metadata.TextList, textUUID)
+}
+
+// Returns the plaintext length of every block in metadata.TextList. For
+// files written before lengths were recorded in Metadata, the lengths are
+// recovered by fetching every block.
+func blockLengths(usr User, metadata Metadata) (lengths []int, err error) {
+	var text Text
+
+	if len(metadata.TextLengths) == len(metadata.TextList) {
+		return metadata.TextLengths, nil
+	}
+	lengths = make([]int, len(metadata.TextList))
+	for i := range metadata.TextList {
+		text, err = getText(usr, metadata, metadata.TextList[i])
+		if err != nil {
+			return nil, err
+		}
+		lengths[i] = len(text.Data)
+	}
+	return lengths, nil
+}
+
+// Reads len(buf) bytes of the file starting at byte offset off, with the
+// semantics of io.ReaderAt: if fewer than len(buf) bytes are read, err
+// explains why (io.EOF at the end of the file).
+//
+// Only the Text blocks that overlap the requested range are fetched and
+// verified; the block boundaries come from the signed Metadata.
+func (usr *User) ReadAt(filename string, buf []byte, off int64) (n int, err error) {
+	// variable declarations
+	var metadata Metadata
+	var text Text
+	var filenameHash string
+	var lengths []int
+	var start, end int64
+
+	if off < 0 {
+		return 0, errors.New(strings.ToTitle("negative offset"))
+	}
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return 0, err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	metadata, _, err = verifyFileAccess(*usr, filenameHash)
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return 0, errors.New(strings.ToTitle("could not verify that user has access to filename"))
+	}
+	lengths, err = blockLengths(*usr, metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	// copy out of every block that overlaps [off, off+len(buf))
+	for i := range metadata.TextList {
+		if n == len(buf) {
+			break
+		}
+		start, end = end, end+int64(lengths[i])
+		if end <= off {
+			continue
+		}
+		text, err = getText(*usr, metadata, metadata.TextList[i])
+		if err != nil {
+			return n, err
+		}
+		if len(text.Data) != lengths[i] {
+			userlib.DebugMsg("text block length does not match file metadata")
+			return n, errors.New(strings.ToTitle("text block length does not match file metadata"))
+		}
+		n += copy(buf[n:], text.Data[off+int64(n)-start:])
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// The structure definition for an io.ReaderAt bound to one file
+type fileReaderAt struct {
+	usr      *User
+	filename string
+}
+
+// Returns an io.ReaderAt over the named file. Every ReadAt call sees the
+// file as it is at the time of the call.
+func (usr *User) FileReaderAt(filename string) io.ReaderAt {
+	return fileReaderAt{usr: usr, filename: filename}
+}
+
+func (r fileReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return r.usr.ReadAt(r.filename, p, off)
+}
@@ -0,0 +1,93 @@
+package proj2
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// A datastore that records which keys were fetched
+type countingDatastore struct {
+	Datastore
+	mu      sync.Mutex
+	fetched map[uuid.UUID]int
+}
+
+func newCountingDatastore() *countingDatastore {
+	return &countingDatastore{Datastore: NewMemoryDatastore(), fetched: make(map[uuid.UUID]int)}
+}
+
+func (store *countingDatastore) Get(key uuid.UUID) ([]byte, bool) {
+	store.mu.Lock()
+	store.fetched[key]++
+	store.mu.Unlock()
+	return store.Datastore.Get(key)
+}
+
+func (store *countingDatastore) reset() {
+	store.mu.Lock()
+	store.fetched = make(map[uuid.UUID]int)
+	store.mu.Unlock()
+}
+
+func TestReadAt(t *testing.T) {
+	store := newCountingDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+
+	blocks := []string{"0123456789", "abcdefghij", "ABCDEFGHIJ", "klmnopqrst"}
+	alice.StoreFile("file1", []byte(blocks[0]))
+	for _, b := range blocks[1:] {
+		alice.AppendFile("file1", []byte(b))
+	}
+	contents := []byte(blocks[0] + blocks[1] + blocks[2] + blocks[3])
+
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+
+	// a range inside blocks 1 and 2 only touches those blocks
+	store.reset()
+	buf := make([]byte, 8)
+	n, err := alice.ReadAt("file1", buf, 15)
+	if err != nil || n != 8 || !bytes.Equal(buf, contents[15:23]) {
+		t.Error("ReadAt returned the wrong data", n, string(buf), err)
+		return
+	}
+	if store.fetched[metadata.TextList[0]] != 0 || store.fetched[metadata.TextList[3]] != 0 {
+		t.Error("ReadAt fetched blocks outside the requested range")
+		return
+	}
+	if store.fetched[metadata.TextList[1]] != 1 || store.fetched[metadata.TextList[2]] != 1 {
+		t.Error("ReadAt did not fetch the blocks in the requested range")
+		return
+	}
+
+	// reading past the end returns what there is and io.EOF
+	n, err = alice.ReadAt("file1", buf, 35)
+	if err != io.EOF || n != 5 || !bytes.Equal(buf[:n], contents[35:]) {
+		t.Error("ReadAt at the end of the file misbehaved", n, err)
+		return
+	}
+	n, err = alice.ReadAt("file1", buf, 100)
+	if err != io.EOF || n != 0 {
+		t.Error("ReadAt past the end of the file misbehaved", n, err)
+		return
+	}
+
+	// every offset and length agrees with LoadFile
+	r := io.NewSectionReader(alice.FileReaderAt("file1"), 0, int64(len(contents)))
+	for off := 0; off < len(contents); off += 7 {
+		got := make([]byte, 13)
+		n, _ := r.ReadAt(got, int64(off))
+		end := off + 13
+		if end > len(contents) {
+			end = len(contents)
+		}
+		if !bytes.Equal(got[:n], contents[off:end]) {
+			t.Error("ReadAt disagrees with file contents at offset", off)
+			return
+		}
+	}
+}
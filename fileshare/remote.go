@@ -0,0 +1,202 @@
+package proj2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ***************************************** REMOTE CLIENT ******************************* //
+
+// Creates a backend that talks to the Server at baseURL (e.g. "http://host:8080").
+// A nil client means http.DefaultClient. Public keys come from the same
+// server, so it has to be trusted for the keystore; see Server.
+func NewRemoteBackend(baseURL string, client *http.Client) Backend {
+	return Backend{
+		Datastore: NewRemoteDatastore(baseURL, client),
+		Keystore:  NewRemoteKeystore(baseURL, client),
+	}
+}
+
+// Sends a request to the server and returns the response body for any 2xx status.
+// A 404 is reported as found = false with no error.
+func remoteDo(client *http.Client, method string, url string, body []byte) (respBody []byte, found bool, err error) {
+	var req *http.Request
+	var resp *http.Response
+
+	req, err = http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	respBody, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, false, errors.New(strings.ToTitle("server returned " + resp.Status + ": " + strings.TrimSpace(string(respBody))))
+	}
+	return respBody, true, nil
+}
+
+// Turns a 404 from an endpoint that should always exist into an error
+func remoteExpect(respBody []byte, found bool, err error) error {
+	if err == nil && !found {
+		return errors.New(strings.ToTitle("server does not serve the fileshare API"))
+	}
+	return err
+}
+
+// RemoteDatastore is a Datastore served by a remote Server
+type RemoteDatastore struct {
+	baseURL string
+	client  *http.Client
+}
+
+// Creates a datastore client for the Server at baseURL. A nil client means http.DefaultClient.
+func NewRemoteDatastore(baseURL string, client *http.Client) *RemoteDatastore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteDatastore{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+// Returns the URL of the record stored under key
+func (store *RemoteDatastore) url(key uuid.UUID) string {
+	return store.baseURL + datastorePath + key.String()
+}
+
+func (store *RemoteDatastore) Get(key uuid.UUID) (value []byte, ok bool) {
+	var err error
+
+	value, ok, err = store.GetChecked(key)
+	if err != nil {
+		userlib.DebugMsg("error fetching remote record " + key.String() + ": " + err.Error())
+		return nil, false
+	}
+	return value, ok
+}
+
+func (store *RemoteDatastore) GetChecked(key uuid.UUID) (value []byte, ok bool, err error) {
+	return remoteDo(store.client, http.MethodGet, store.url(key), nil)
+}
+
+func (store *RemoteDatastore) Set(key uuid.UUID, value []byte) (err error) {
+	return remoteExpect(remoteDo(store.client, http.MethodPut, store.url(key), value))
+}
+
+// Sends a conditional PUT; the server answers 412 if the record has changed
+func (store *RemoteDatastore) CompareAndSwap(key uuid.UUID, old []byte, value []byte) (swapped bool, err error) {
+	var req *http.Request
+	var resp *http.Response
+	var body []byte
+
+	req, err = http.NewRequest(http.MethodPut, store.url(key), bytes.NewReader(value))
+	if err != nil {
+		return false, err
+	}
+	if old == nil {
+		req.Header.Set("If-None-Match", "*")
+	} else {
+		req.Header.Set("If-Match", recordETag(old))
+	}
+	resp, err = store.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return false, errors.New(strings.ToTitle("server returned " + resp.Status + ": " + strings.TrimSpace(string(body))))
+	}
+	return true, nil
+}
+
+func (store *RemoteDatastore) Delete(key uuid.UUID) (err error) {
+	return remoteExpect(remoteDo(store.client, http.MethodDelete, store.url(key), nil))
+}
+
+func (store *RemoteDatastore) List() (keys []uuid.UUID, err error) {
+	var body []byte
+	var ok bool
+
+	body, ok, err = remoteDo(store.client, http.MethodGet, store.baseURL+datastorePath, nil)
+	err = remoteExpect(body, ok, err)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(body, &keys)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RemoteKeystore is a Keystore served by a remote Server
+type RemoteKeystore struct {
+	baseURL string
+	client  *http.Client
+}
+
+// Creates a keystore client for the Server at baseURL. A nil client means http.DefaultClient.
+func NewRemoteKeystore(baseURL string, client *http.Client) *RemoteKeystore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &RemoteKeystore{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+// Returns the URL of the keystore entry stored under key
+func (ks *RemoteKeystore) url(key string) string {
+	return ks.baseURL + keystorePath + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func (ks *RemoteKeystore) Get(key string) (value userlib.PublicKeyType, ok bool) {
+	var body []byte
+	var err error
+
+	body, ok, err = remoteDo(ks.client, http.MethodGet, ks.url(key), nil)
+	if err != nil {
+		userlib.DebugMsg("error fetching remote keystore entry " + key + ": " + err.Error())
+		return value, false
+	}
+	if !ok {
+		return value, false
+	}
+	err = json.Unmarshal(body, &value)
+	if err != nil {
+		userlib.DebugMsg("error unmarshalling remote keystore entry " + key)
+		return value, false
+	}
+	return value, true
+}
+
+func (ks *RemoteKeystore) Set(key string, value userlib.PublicKeyType) (err error) {
+	var body []byte
+
+	body, err = json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return remoteExpect(remoteDo(ks.client, http.MethodPut, ks.url(key), body))
+}
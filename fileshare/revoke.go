@@ -0,0 +1,452 @@
+package proj2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ******************************************* REVOCATION ******************************** //
+
+// RevokeFile never re-encrypts a Text block in place. Each block is copied
+// to a new UUID under the new keys while the original stays readable, and
+// the file switches over in one step, when Metadata pointing at the copies
+// is posted with compare-and-set. Only after that is the Sentinel given the
+// new Metadata key and are the originals deleted. Before anything is
+// copied, a journal holding the new keys and where each block is copied to
+// is posted next to the Metadata, encrypted to and signed by the owner. If
+// a revocation is interrupted, the journal lets the owner finish it, when
+// Metadata was already posted, or undo it otherwise. The journal records
+// the Sentinel lock and Metadata Revision it started from, and is only acted
+// on while the file is still in that state, so an old journal posted again
+// is never replayed.
+
+// The structure definition for a revocation in progress
+type RevokeJournal struct {
+	MetadataUUID uuid.UUID
+	Target       string
+	MetadataKey  []byte
+	TextEncKey   []byte
+	TextMACKey   []byte
+	OldLock      []byte                  // Sentinel lock value of the Metadata key being replaced
+	Revision     uint64                  // Revision of the Metadata being re-keyed
+	Blocks       map[uuid.UUID]uuid.UUID // each block -> its copy under the new keys; nil until the append log is sealed
+}
+
+// The structure definition for a journal as stored: the journal sealed
+// under a fresh key, and that key encrypted to the owner
+type SealedJournal struct {
+	Key  []byte
+	Body []byte
+}
+
+// Returns the UUID of the revocation journal of the file whose Metadata is
+// at metadataUUID
+func revokeJournalUUID(metadataUUID uuid.UUID) (ret uuid.UUID) {
+	var hash = userlib.Hash([]byte(metadataUUID.String() + "-revoke"))
+	copy(ret[:], hash[:16])
+	return ret
+}
+
+// Returned by postRevokeJournal when the journal is not the one expected,
+// because another revocation of the file has started
+var errRevocationInProgress = errors.New(strings.ToTitle("file is already being revoked"))
+
+// Encrypts journal to usr, signs it and posts it with compare-and-set over
+// old, the journal as last posted, or nil when there must be none yet.
+// Returns the journal as posted.
+func postRevokeJournal(usr User, journal RevokeJournal, old []byte) (val []byte, err error) {
+	// variable declarations
+	var sealed SealedJournal
+	var ownerPKEEnc userlib.PKEEncKey
+	var journalKey []byte
+	var ok, swapped bool
+
+	ownerPKEEnc, ok = usr.backend.Keystore.Get(usr.Username + "-PKEEncKey")
+	if !ok {
+		userlib.DebugMsg(usr.Username + " does not have a posted PKE Encryption Key!")
+		return nil, errors.New(strings.ToTitle("cannot find owner's PKE Encryption key!"))
+	}
+	journalKey = userlib.RandomBytes(userlib.AESBlockSize)
+	sealed.Key, err = userlib.PKEEnc(ownerPKEEnc, journalKey)
+	if err != nil {
+		userlib.DebugMsg("error RSA-encrypting revocation journal key")
+		return nil, err
+	}
+	sealed.Body, err = sealStruct(journal, journalKey, nil, nil, usr, true)
+	if err != nil {
+		userlib.DebugMsg("error sealing revocation journal")
+		return nil, err
+	}
+	val, err = json.Marshal(sealed)
+	if err != nil {
+		userlib.DebugMsg("error marshalling revocation journal")
+		return nil, err
+	}
+	swapped, err = compareAndSwap(usr.backend.Datastore, revokeJournalUUID(journal.MetadataUUID), old, val)
+	if err != nil {
+		userlib.DebugMsg("error posting revocation journal")
+		return nil, err
+	}
+	if !swapped {
+		userlib.DebugMsg("revocation journal was replaced by another revocation")
+		return nil, errRevocationInProgress
+	}
+	return val, nil
+}
+
+// Retrieves, verifies and decrypts usr's revocation journal for the file
+// whose Metadata is at metadataUUID. present is false if no revocation of
+// the file is in progress.
+func getRevokeJournal(usr User, metadataUUID uuid.UUID) (journal RevokeJournal, present bool, err error) {
+	// variable declarations
+	var sealed SealedJournal
+	var ownerDSPub userlib.DSVerifyKey
+	var journalKey, plaintext, ciphertext, sig, val []byte
+	var ok bool
+
+	// retrieve from datastore and split val into components
+	val, ok = usr.backend.Datastore.Get(revokeJournalUUID(metadataUUID))
+	if !ok {
+		return journal, false, nil
+	}
+	err = json.Unmarshal(val, &sealed)
+	if err != nil {
+		userlib.DebugMsg("error unmarshalling revocation journal")
+		return journal, true, err
+	}
+	if len(sealed.Body) < userlib.RSAKeySize/8 {
+		userlib.DebugMsg("revocation journal was corrupted in datastore (not enough info)")
+		return journal, true, errors.New(strings.ToTitle("revocation journal was corrupted in datastore (not enough info)"))
+	}
+	sig = sealed.Body[:userlib.RSAKeySize/8]
+	ciphertext = sealed.Body[userlib.RSAKeySize/8:]
+
+	// only the owner writes the journal, so the signer is known before decrypting
+	ownerDSPub, ok = usr.backend.Keystore.Get(usr.Username + "-DSVerifyKey")
+	if !ok {
+		userlib.DebugMsg(usr.Username + " does not have a posted DS Verify Key!")
+		return journal, true, errors.New(strings.ToTitle("cannot find owner's DS Verify key!"))
+	}
+	err = userlib.DSVerify(ownerDSPub, ciphertext, sig)
+	if err != nil {
+		userlib.DebugMsg("signature on revocation journal did not match; data has been corrupted")
+		return journal, true, err
+	}
+	journalKey, err = userlib.PKEDec(usr.PKEDec, sealed.Key)
+	if err != nil {
+		userlib.DebugMsg("error decrypting revocation journal key")
+		return journal, true, err
+	}
+	if len(ciphertext)%userlib.AESBlockSize != 0 {
+		userlib.DebugMsg("ciphertext is not a multiple of the block size!")
+		return journal, true, errors.New(strings.ToTitle("ciphertext is not a multiple of the block size!"))
+	}
+	plaintext = userlib.SymDec(journalKey, ciphertext)
+	plaintext = unpad(plaintext)
+	err = json.Unmarshal(plaintext, &journal)
+	if err != nil {
+		userlib.DebugMsg("error unmarshalling revocation journal")
+		return journal, true, err
+	}
+	if journal.MetadataUUID != metadataUUID {
+		userlib.DebugMsg("revocation journal was moved from another file!")
+		return journal, true, errors.New(strings.ToTitle("revocation journal was moved from another file!"))
+	}
+	return journal, true, nil
+}
+
+// Switches metadata, read along with raw under metadataKey, over to the
+// keys in journal: seals the append log, copies every block the file
+// refers to under the new keys, and posts metadata pointing at the copies.
+// journal, last posted as posted, is posted again with compare-and-set
+// once the blocks to copy are known. Nothing the file refers to changes until metadata is posted,
+// so on failure the revocation can be undone.
+func rekeyFile(usr User, metadata *Metadata, metadataKey []byte, raw []byte, journal *RevokeJournal, posted []byte) (err error) {
+	// variable declarations
+	var codecs map[uuid.UUID]string
+	var blocks []uuid.UUID
+
+	// seal the append log so that appenders holding the old keys start over;
+	// blocks appended before the seal are re-keyed with the rest
+	err = sealAppendLog(usr, metadata, metadataKey)
+	if err != nil {
+		userlib.DebugMsg("error sealing append log")
+		return err
+	}
+
+	// journal a new UUID for every block, including those only kept versions refer to
+	codecs = referencedText(*metadata)
+	journal.Blocks = make(map[uuid.UUID]uuid.UUID)
+	for textUUID := range codecs {
+		journal.Blocks[textUUID] = uuid.New()
+		blocks = append(blocks, textUUID)
+	}
+	_, err = postRevokeJournal(usr, *journal, posted)
+	if err != nil {
+		return err
+	}
+
+	// copy the blocks, several at a time
+	err = inParallel(len(blocks), usr.backend.Concurrency, func(i int) (err error) {
+		var text Text
+		var old = *metadata
+
+		old.Compression = codecs[blocks[i]]
+		text, err = getText(usr, old, blocks[i])
+		if err != nil {
+			userlib.DebugMsg("cannot load text block to re-key")
+			return err
+		}
+		text.TextUUID = journal.Blocks[blocks[i]]
+		err = postText(usr, text, Metadata{TextEncKey: journal.TextEncKey, TextMACKey: journal.TextMACKey, Compression: codecs[blocks[i]]})
+		if err != nil {
+			userlib.DebugMsg("error posting re-keyed text block")
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// point metadata at the copies and post it under the new key, with an
+	// append log the revoked user cannot find; the sealed one is kept for
+	// appenders that still hold the old keys
+	remapBlocks(metadata, journal.Blocks)
+	metadata.TextEncKey = journal.TextEncKey
+	metadata.TextMACKey = journal.TextMACKey
+	metadata.RetiredAppendLogs = append(metadata.RetiredAppendLogs, appendLogID(*metadata))
+	metadata.AppendLog = uuid.New()
+	metadata.AppendsFolded = 0
+	metadata.LastModified = usr.Username
+	return postMetadataCAS(usr, metadata, journal.MetadataKey, raw)
+}
+
+// Points every block list in metadata at the copies in blocks
+func remapBlocks(metadata *Metadata, blocks map[uuid.UUID]uuid.UUID) {
+	var remap = func(textList []uuid.UUID) (ret []uuid.UUID) {
+		ret = make([]uuid.UUID, len(textList))
+		for i, textUUID := range textList {
+			ret[i] = blocks[textUUID]
+		}
+		return ret
+	}
+
+	metadata.TextList = remap(metadata.TextList)
+	for i := range metadata.Versions {
+		metadata.Versions[i].TextList = remap(metadata.Versions[i].TextList)
+	}
+	for pinID, pin := range metadata.Pins {
+		pin.TextList = remap(pin.TextList)
+		metadata.Pins[pinID] = pin
+	}
+}
+
+// Completes a revocation whose Metadata has been posted: gives every user
+// left in metadata.AccessMap the new Metadata key in the Sentinel, then
+// deletes the blocks that were copied and the journal. Safe to repeat.
+func finishRevocation(usr User, sentinelUUID uuid.UUID, metadata Metadata, journal RevokeJournal) (err error) {
+	// variable declarations
+	var sentinel Sentinel
+	var nodePKEEnc userlib.PKEEncKey
+	var copied []uuid.UUID
+	var ok bool
+
+	// Update file sentinel and post
+	sentinel, err = getSentinel(usr, sentinelUUID)
+	if err != nil {
+		return err
+	}
+	sentinel.MetadataKeyMap = make(map[string][]byte)
+	for k := range metadata.AccessMap {
+		nodePKEEnc, ok = usr.backend.Keystore.Get(k + "-PKEEncKey")
+		if !ok {
+			userlib.DebugMsg("Error finding node's PKEEnc Key")
+			return errors.New(strings.ToTitle("Could not compute new PKEs for file sentinel."))
+		}
+		sentinel.MetadataKeyMap[k], err = userlib.PKEEnc(nodePKEEnc, journal.MetadataKey)
+		if err != nil {
+			userlib.DebugMsg("error RSA-encrypting file metadata key")
+			return err
+		}
+	}
+	sentinel.Lock, err = userlib.DSSign(usr.DSSign, getSentinelLockVal(metadata.MetadataUUID, journal.MetadataKey))
+	if err != nil {
+		userlib.DebugMsg("error computing sentinel lock value")
+		return err
+	}
+	err = postSentinel(usr, sentinel, sentinelUUID)
+	if err != nil {
+		return err
+	}
+
+	// the file no longer refers to the blocks under the old keys
+	for textUUID := range journal.Blocks {
+		copied = append(copied, textUUID)
+	}
+	err = releaseText(usr, metadata, copied)
+	if err != nil {
+		return err
+	}
+	err = usr.backend.Datastore.Delete(revokeJournalUUID(metadata.MetadataUUID))
+	if err != nil {
+		userlib.DebugMsg("error deleting revocation journal")
+		return err
+	}
+	return nil
+}
+
+// Returned by undoRevocation when the revocation's Metadata turns out to
+// have been posted after all, so it has to be finished instead
+var errRevocationCommitted = errors.New(strings.ToTitle("revocation was already committed"))
+
+// Undoes a revocation whose Metadata was never posted: moves Metadata past
+// the seal it left in the append log, then deletes the copies it made and
+// the journal. Moving Metadata only succeeds if it still opens under the
+// old key and does not use the new block keys, so copies are never deleted
+// once the file has switched to them; errRevocationCommitted is returned
+// instead. The file stays readable under its old keys throughout.
+func undoRevocation(usr User, filenameHash string, journal RevokeJournal) (err error) {
+	// variable declarations
+	var metadata Metadata
+	var live map[uuid.UUID]string
+	var copies []uuid.UUID
+
+	metadata, _, err = updateMetadata(usr, filenameHash, func(metadata *Metadata) error {
+		if bytes.Equal(metadata.TextEncKey, journal.TextEncKey) {
+			userlib.DebugMsg("file metadata already uses the revocation's keys")
+			return errRevocationCommitted
+		}
+		unsealAppendLog(usr, metadata)
+		metadata.LastModified = usr.Username
+		return nil
+	})
+	if err != nil {
+		userlib.DebugMsg("error moving file metadata past append log seal")
+		return err
+	}
+
+	// only copies the file does not refer to are left over
+	live = referencedText(metadata)
+	for _, textUUID := range journal.Blocks {
+		if _, ok := live[textUUID]; !ok {
+			copies = append(copies, textUUID)
+		}
+	}
+	err = deleteText(usr, copies)
+	if err != nil {
+		return err
+	}
+	err = usr.backend.Datastore.Delete(revokeJournalUUID(journal.MetadataUUID))
+	if err != nil {
+		userlib.DebugMsg("error deleting revocation journal")
+		return err
+	}
+	return nil
+}
+
+// Returned by recoverRevocation when a journal matches the Sentinel but
+// not the Metadata it is meant to finish or undo
+var errJournalMismatch = errors.New(strings.ToTitle("revocation journal does not match file metadata"))
+
+// Finishes or undoes an interrupted revocation of the file under
+// filenameHash, if usr owns it and one is in progress. A revocation whose
+// Metadata was posted is always finished. One whose Metadata was not is
+// only undone if undo is true, since it may still be running in another
+// session. A journal that did not start from the key the Sentinel holds is
+// left over from an earlier revocation and is discarded without being
+// acted on. Reports whether a revocation was finished or undone.
+func recoverRevocation(usr User, filenameHash string, undo bool) (recovered bool, err error) {
+	// variable declarations
+	var journal RevokeJournal
+	var sentinel Sentinel
+	var metadata Metadata
+	var sentinelUUID uuid.UUID
+	var ownerDSPub userlib.DSVerifyKey
+	var metadataKey, lockVal []byte
+	var present, ok bool
+
+	sentinelUUID, ok = usr.UUIDMap[filenameHash]
+	if !ok || usr.OwnerMap[filenameHash] != usr.Username {
+		return false, nil
+	}
+	sentinel, err = getSentinel(usr, sentinelUUID)
+	if err != nil {
+		return false, err
+	}
+	journal, present, err = getRevokeJournal(usr, sentinel.MetadataUUID)
+	if err != nil || !present {
+		return false, err
+	}
+
+	// find the Metadata key the Sentinel holds now
+	metadataKey, err = userlib.PKEDec(usr.PKEDec, sentinel.MetadataKeyMap[usr.Username])
+	if err != nil {
+		userlib.DebugMsg("error decrypting file metadata key")
+		return false, err
+	}
+	ownerDSPub, ok = usr.backend.Keystore.Get(usr.Username + "-DSVerifyKey")
+	if !ok {
+		userlib.DebugMsg(usr.Username + " does not have a posted DS Verify Key!")
+		return false, errors.New(strings.ToTitle("cannot find owner's DS Verify key!"))
+	}
+	lockVal = getSentinelLockVal(sentinel.MetadataUUID, metadataKey)
+	err = userlib.DSVerify(ownerDSPub, lockVal, sentinel.Lock)
+	if err != nil {
+		userlib.DebugMsg("could not verify file sentinel lock; data is corrupted!")
+		return false, err
+	}
+
+	// the Sentinel already holds the new key; only clean-up is left
+	if bytes.Equal(metadataKey, journal.MetadataKey) {
+		metadata, _, err = getMetadata(usr, sentinel.MetadataUUID, metadataKey)
+		if err != nil {
+			return false, err
+		}
+		if metadata.Revision <= journal.Revision {
+			userlib.DebugMsg("file metadata is older than the revocation that re-keyed it")
+			return false, errJournalMismatch
+		}
+		userlib.DebugMsg("finishing interrupted revocation of " + journal.Target)
+		return true, finishRevocation(usr, sentinelUUID, metadata, journal)
+	}
+	if !bytes.Equal(lockVal, journal.OldLock) {
+		userlib.DebugMsg("discarding revocation journal that did not start from the current key")
+		err = usr.backend.Datastore.Delete(revokeJournalUUID(sentinel.MetadataUUID))
+		if err != nil {
+			userlib.DebugMsg("error deleting revocation journal")
+		}
+		return false, err
+	}
+
+	// Metadata that opens under the journal's key was posted by the revocation,
+	// as the one post after the Revision it read
+	if journal.Blocks != nil {
+		metadata, _, err = getMetadata(usr, sentinel.MetadataUUID, journal.MetadataKey)
+		if err == nil {
+			if metadata.Revision != journal.Revision+1 {
+				userlib.DebugMsg("file metadata was not posted by the revocation being finished")
+				return false, errJournalMismatch
+			}
+			userlib.DebugMsg("finishing interrupted revocation of " + journal.Target)
+			return true, finishRevocation(usr, sentinelUUID, metadata, journal)
+		}
+	}
+	if !undo {
+		return false, nil
+	}
+	metadata, _, err = getMetadata(usr, sentinel.MetadataUUID, metadataKey)
+	if err != nil {
+		return false, err
+	}
+	if metadata.Revision < journal.Revision {
+		userlib.DebugMsg("file metadata is older than the revocation being undone")
+		return false, errJournalMismatch
+	}
+	userlib.DebugMsg("undoing interrupted revocation of " + journal.Target)
+	return true, undoRevocation(usr, filenameHash, journal)
+}
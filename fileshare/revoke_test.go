@@ -0,0 +1,307 @@
+package proj2
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// A datastore whose writes fail when fail says so, as if the client had
+// crashed or lost its connection part way through an operation
+type failingDatastore struct {
+	Datastore
+	mu      sync.Mutex
+	fail    func(key uuid.UUID) bool
+	applied bool // failing writes still take effect, like a timeout after the server applied them
+}
+
+func (store *failingDatastore) failing(key uuid.UUID) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.fail != nil && store.fail(key)
+}
+
+func (store *failingDatastore) Set(key uuid.UUID, value []byte) error {
+	if store.failing(key) {
+		if store.applied {
+			store.Datastore.Set(key, value)
+		}
+		return errors.New("injected write failure")
+	}
+	return store.Datastore.Set(key, value)
+}
+
+func (store *failingDatastore) Delete(key uuid.UUID) error {
+	if store.failing(key) {
+		return errors.New("injected write failure")
+	}
+	return store.Datastore.Delete(key)
+}
+
+// Makes the nth write from now fail, and only that one if once is true;
+// otherwise every write from the nth on fails
+func (store *failingDatastore) failAfter(n int, once bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.fail = func(key uuid.UUID) bool {
+		n--
+		return n == 0 || (!once && n < 0)
+	}
+}
+
+func (store *failingDatastore) disarm() {
+	store.mu.Lock()
+	store.fail = nil
+	store.mu.Unlock()
+}
+
+// Stores a file of several blocks as alice and shares it with bob and carol
+func revokeTestSetup() (store *failingDatastore, alice *User, bob *User, carol *User) {
+	store = &failingDatastore{Datastore: NewMemoryDatastore()}
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ = InitUserWithBackend(backend, "alice", "foo")
+	bob, _ = InitUserWithBackend(backend, "bob", "bar")
+	carol, _ = InitUserWithBackend(backend, "carol", "baz")
+	alice.StoreFile("file1", []byte("one;"))
+	alice.AppendFile("file1", []byte("two;"))
+	alice.AppendFile("file1", []byte("three;"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+	magic, _ = alice.ShareFile("file1", "carol")
+	carol.ReceiveFile("shared", "alice", magic)
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	return store, alice, bob, carol
+}
+
+func TestRevokeFailureRollsBack(t *testing.T) {
+	store, alice, bob, carol := revokeTestSetup()
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	before, _ := store.List()
+
+	// journal, seal, journal again, then the second block copy fails
+	store.failAfter(5, true)
+	if err := alice.RevokeFile("file1", "bob"); err == nil {
+		t.Error("Revoke succeeded despite a failed write")
+		return
+	}
+	store.disarm()
+
+	// nothing changed but the seal left in the append log, which is skipped
+	after, _ := store.List()
+	if len(after) != len(before)+1 {
+		t.Error("Failed revoke left records behind", len(before), len(after))
+		return
+	}
+	if _, ok := store.Get(revokeJournalUUID(metadata.MetadataUUID)); ok {
+		t.Error("Failed revoke left its journal behind")
+		return
+	}
+	if err := bob.AppendFile("shared", []byte("bob;")); err != nil {
+		t.Error("Append log stayed sealed after a failed revoke", err)
+		return
+	}
+	if !checkContents(t, carol, "shared", []byte("one;two;three;bob;")) {
+		return
+	}
+
+	if err := alice.RevokeFile("file1", "bob"); err != nil {
+		t.Error("Failed to revoke after a failed attempt", err)
+		return
+	}
+	if _, err := bob.LoadFile("shared"); err == nil {
+		t.Error("Revoked user could still load the file")
+		return
+	}
+	checkContents(t, carol, "shared", []byte("one;two;three;bob;"))
+}
+
+func TestRevokeInterruptedAfterCommit(t *testing.T) {
+	store, alice, bob, carol := revokeTestSetup()
+	sentinelUUID := alice.UUIDMap[getFilenameHash("file1", "alice")]
+	store.mu.Lock()
+	store.fail = func(key uuid.UUID) bool { return key == sentinelUUID }
+	store.mu.Unlock()
+	if err := alice.RevokeFile("file1", "bob"); err == nil {
+		t.Error("Revoke succeeded despite a failed Sentinel write")
+		return
+	}
+	store.disarm()
+
+	// Metadata is under the new key, so only the journal can open the file
+	if _, err := carol.LoadFile("shared"); err == nil {
+		t.Error("Loaded file through a Sentinel that was never re-keyed")
+		return
+	}
+	report, err := MarkAndSweep(alice.backend, SweepRoots{Credentials: map[string]string{"alice": "foo", "bob": "bar", "carol": "baz"}}, false)
+	if err != nil || len(report.Unreachable) != 0 {
+		t.Error("Mark and sweep would delete records of an interrupted revoke", err, report.Unreachable)
+		return
+	}
+
+	// the owner's next access finishes the revocation
+	if !checkContents(t, alice, "file1", []byte("one;two;three;")) {
+		return
+	}
+	if !checkContents(t, carol, "shared", []byte("one;two;three;")) {
+		return
+	}
+	if _, err := bob.LoadFile("shared"); err == nil {
+		t.Error("Revoked user could still load the file")
+		return
+	}
+	report, _ = MarkAndSweep(alice.backend, SweepRoots{Credentials: map[string]string{"alice": "foo", "bob": "bar", "carol": "baz"}}, false)
+	if len(report.Unreachable) != 0 {
+		t.Error("Finished revoke left records behind", report.Unreachable)
+		return
+	}
+}
+
+func TestRevokeInterruptedBeforeCommit(t *testing.T) {
+	store, alice, bob, carol := revokeTestSetup()
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+
+	// every write fails after the first block copy, so nothing can be undone
+	store.failAfter(5, false)
+	if err := alice.RevokeFile("file1", "bob"); err == nil {
+		t.Error("Revoke succeeded despite failed writes")
+		return
+	}
+	store.disarm()
+	if _, ok := store.Get(revokeJournalUUID(metadata.MetadataUUID)); !ok {
+		t.Error("Interrupted revoke left no journal")
+		return
+	}
+	if !checkContents(t, carol, "shared", []byte("one;two;three;")) {
+		return
+	}
+	if err := carol.AppendFile("shared", []byte("carol;")); err == nil {
+		t.Error("Appended past the seal of an interrupted revoke")
+		return
+	}
+
+	// revoking again undoes the interrupted attempt first
+	if err := alice.RevokeFile("file1", "bob"); err != nil {
+		t.Error("Failed to revoke after an interrupted attempt", err)
+		return
+	}
+	if _, err := bob.LoadFile("shared"); err == nil {
+		t.Error("Revoked user could still load the file")
+		return
+	}
+	if err := carol.AppendFile("shared", []byte("carol;")); err != nil {
+		t.Error("Failed to append after revoke", err)
+		return
+	}
+	if !checkContents(t, carol, "shared", []byte("one;two;three;carol;")) {
+		return
+	}
+	report, _ := MarkAndSweep(alice.backend, SweepRoots{Credentials: map[string]string{"alice": "foo", "bob": "bar", "carol": "baz"}}, false)
+	if len(report.Unreachable) != 0 {
+		t.Error("Recovered revoke left records behind", report.Unreachable)
+		return
+	}
+}
+
+func TestRevokeCommitReportedAsFailure(t *testing.T) {
+	store, alice, bob, carol := revokeTestSetup()
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+
+	// the Metadata post lands but the client is told it failed
+	failed := false
+	store.mu.Lock()
+	store.applied = true
+	store.fail = func(key uuid.UUID) bool {
+		if key == metadata.MetadataUUID && !failed {
+			failed = true
+			return true
+		}
+		return false
+	}
+	store.mu.Unlock()
+	if err := alice.RevokeFile("file1", "bob"); err != nil {
+		t.Error("Revoke whose Metadata post landed was not finished", err)
+		return
+	}
+	store.disarm()
+	if !failed {
+		t.Error("Metadata was never posted")
+		return
+	}
+	if !checkContents(t, carol, "shared", []byte("one;two;three;")) {
+		return
+	}
+	if _, err := bob.LoadFile("shared"); err == nil {
+		t.Error("Revoked user could still load the file")
+		return
+	}
+}
+
+func TestRevokeJournalReplay(t *testing.T) {
+	store, alice, bob, carol := revokeTestSetup()
+	filenameHash := getFilenameHash("file1", "alice")
+	metadata, _, _ := verifyFileAccess(*alice, filenameHash)
+
+	// keep the journal of an interrupted attempt, then revoke for real
+	store.failAfter(5, false)
+	alice.RevokeFile("file1", "bob")
+	store.disarm()
+	stale, ok := store.Get(revokeJournalUUID(metadata.MetadataUUID))
+	if !ok {
+		t.Error("Interrupted revoke left no journal")
+		return
+	}
+	if err := alice.RevokeFile("file1", "bob"); err != nil {
+		t.Error("Failed to revoke after an interrupted attempt", err)
+		return
+	}
+
+	// the old journal posted again is discarded, not undone
+	store.Set(revokeJournalUUID(metadata.MetadataUUID), stale)
+	recovered, err := recoverRevocation(*alice, filenameHash, true)
+	if err != nil || recovered {
+		t.Error("Acted on a replayed revocation journal", recovered, err)
+		return
+	}
+	if _, ok = store.Get(revokeJournalUUID(metadata.MetadataUUID)); ok {
+		t.Error("Replayed revocation journal was kept")
+		return
+	}
+	if !checkContents(t, carol, "shared", []byte("one;two;three;")) {
+		return
+	}
+	if _, err = bob.LoadFile("shared"); err == nil {
+		t.Error("Revoked user could still load the file")
+		return
+	}
+}
+
+func TestRevokeJournalExclusive(t *testing.T) {
+	_, alice, _, _ := revokeTestSetup()
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	journal := RevokeJournal{MetadataUUID: metadata.MetadataUUID, Target: "bob"}
+
+	// a second revocation cannot start over the first one's journal
+	posted, err := postRevokeJournal(*alice, journal, nil)
+	if err != nil {
+		t.Error("Failed to post revocation journal", err)
+		return
+	}
+	if _, err = postRevokeJournal(*alice, RevokeJournal{MetadataUUID: metadata.MetadataUUID, Target: "carol"}, nil); err != errRevocationInProgress {
+		t.Error("Second revocation replaced the first one's journal", err)
+		return
+	}
+	if err = alice.RevokeFile("file1", "carol"); err != nil {
+		// the stale journal is undone before revoking again
+		t.Error("Failed to revoke over an abandoned journal", err)
+		return
+	}
+
+	// the first revocation can no longer post its journal again
+	journal.Blocks = make(map[uuid.UUID]uuid.UUID)
+	if _, err = postRevokeJournal(*alice, journal, posted); err != errRevocationInProgress {
+		t.Error("Re-posted a journal that had been replaced", err)
+		return
+	}
+}
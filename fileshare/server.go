@@ -0,0 +1,229 @@
+package proj2
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ********************************************* SERVER ********************************** //
+
+// The HTTP interface served by Server and spoken by RemoteDatastore and RemoteKeystore:
+//
+//	GET    /datastore/           JSON array of every record UUID
+//	GET    /datastore/<uuid>     raw record bytes with an ETag, 404 if missing
+//	PUT    /datastore/<uuid>     store the request body as the record; with
+//	                             If-Match: <etag> or If-None-Match: *, only
+//	                             if the record still matches, else 412
+//	DELETE /datastore/<uuid>     remove the record
+//	GET    /keystore/<name>      JSON-encoded public key, 404 if missing
+//	PUT    /keystore/<name>      store a JSON-encoded public key, 409 if taken
+//
+// Keystore names are arbitrary strings, so <name> is their unpadded
+// base64url encoding.
+const (
+	datastorePath = "/datastore/"
+	keystorePath  = "/keystore/"
+
+	// Largest record a Server accepts unless its MaxRecordSize is set: a
+	// block of DefaultBlockSize with room to spare for its encoding
+	DefaultMaxRecordSize = DefaultBlockSize + 4<<20
+
+	// Largest keystore entry the server will accept; public keys are far smaller
+	maxKeySize = 64 << 10
+)
+
+// Returns the entity tag the server reports for a record value
+func recordETag(value []byte) string {
+	var sum = sha256.Sum256(value)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Server exposes a Datastore and a Keystore over HTTP. Datastore records are
+// encrypted and authenticated before they leave the client, so the server
+// need not be trusted with them. Keystore entries are not: clients take the
+// public keys the server hands out as genuine, so whoever runs the server
+// can substitute their own and read or forge what is shared from then on.
+// The server has to be trusted for the keystore.
+type Server struct {
+	Datastore Datastore
+	Keystore  Keystore
+
+	// Largest record the server accepts, in bytes. Zero means
+	// DefaultMaxRecordSize. StoreFile and AppendFile post their data as one
+	// Text block, so larger writes need a larger limit, or OpenAppender.
+	MaxRecordSize int64
+}
+
+// Creates a server for the given stores
+func NewServer(ds Datastore, ks Keystore) *Server {
+	return &Server{Datastore: ds, Keystore: ks}
+}
+
+// Returns the largest record srv accepts
+func (srv *Server) maxRecordSize() int64 {
+	if srv.MaxRecordSize <= 0 {
+		return DefaultMaxRecordSize
+	}
+	return srv.MaxRecordSize
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var path = r.URL.EscapedPath()
+
+	switch {
+	case strings.HasPrefix(path, datastorePath):
+		srv.serveDatastore(w, r, strings.TrimPrefix(path, datastorePath))
+	case strings.HasPrefix(path, keystorePath):
+		srv.serveKeystore(w, r, strings.TrimPrefix(path, keystorePath))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Handles requests under /datastore/
+func (srv *Server) serveDatastore(w http.ResponseWriter, r *http.Request, name string) {
+	var key uuid.UUID
+	var keys []uuid.UUID
+	var value []byte
+	var ok bool
+	var err error
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		keys, err = srv.Datastore.List()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if keys == nil {
+			keys = []uuid.UUID{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+		return
+	}
+
+	key, err = uuid.Parse(name)
+	if err != nil {
+		http.Error(w, "malformed record UUID", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, ok = srv.Datastore.Get(key)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", recordETag(value))
+		w.Write(value)
+	case http.MethodPut:
+		value, err = io.ReadAll(http.MaxBytesReader(w, r.Body, srv.maxRecordSize()))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Header.Get("If-Match") == "" && r.Header.Get("If-None-Match") == "" {
+			err = srv.Datastore.Set(key, value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		srv.putConditional(w, r, key, value)
+	case http.MethodDelete:
+		err = srv.Datastore.Delete(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Handles a PUT with If-Match or If-None-Match by compare-and-swapping
+// against the record the client's precondition names
+func (srv *Server) putConditional(w http.ResponseWriter, r *http.Request, key uuid.UUID, value []byte) {
+	var cur, old []byte
+	var ok, swapped bool
+	var err error
+
+	cur, ok = srv.Datastore.Get(key)
+	switch {
+	case r.Header.Get("If-None-Match") == "*":
+		old = nil
+	case ok && r.Header.Get("If-Match") == recordETag(cur):
+		old = cur
+	default:
+		http.Error(w, "record does not match precondition", http.StatusPreconditionFailed)
+		return
+	}
+	swapped, err = compareAndSwap(srv.Datastore, key, old, value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !swapped {
+		http.Error(w, "record does not match precondition", http.StatusPreconditionFailed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles requests under /keystore/
+func (srv *Server) serveKeystore(w http.ResponseWriter, r *http.Request, name string) {
+	var key []byte
+	var value userlib.PublicKeyType
+	var ok bool
+	var err error
+
+	key, err = base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		http.Error(w, "malformed keystore name", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, ok = srv.Keystore.Get(string(key))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
+	case http.MethodPut:
+		err = json.NewDecoder(http.MaxBytesReader(w, r.Body, maxKeySize)).Decode(&value)
+		if err != nil {
+			http.Error(w, "malformed public key", http.StatusBadRequest)
+			return
+		}
+		if _, ok = srv.Keystore.Get(string(key)); ok {
+			http.Error(w, "keystore entry is already taken", http.StatusConflict)
+			return
+		}
+		err = srv.Keystore.Set(string(key), value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,126 @@
+package proj2
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Starts a server over fresh in-memory stores; returns it with a backend that talks to it
+func remoteTestServer() (*httptest.Server, *MemoryDatastore, Backend) {
+	ds := NewMemoryDatastore()
+	ts := httptest.NewServer(NewServer(ds, NewMemoryKeystore()))
+	return ts, ds, NewRemoteBackend(ts.URL, ts.Client())
+}
+
+func TestRemoteDatastore(t *testing.T) {
+	ts, ds, backend := remoteTestServer()
+	defer ts.Close()
+
+	k := uuid.New()
+	if _, ok := backend.Datastore.Get(k); ok {
+		t.Error("Got a value for a key that was never set")
+		return
+	}
+	err := backend.Datastore.Set(k, []byte("some value"))
+	if err != nil {
+		t.Error("Failed to set remote record", err)
+		return
+	}
+	if v, ok := ds.Get(k); !ok || string(v) != "some value" {
+		t.Error("Remote set did not reach the server's datastore", string(v))
+		return
+	}
+	keys, err := backend.Datastore.List()
+	if err != nil || len(keys) != 1 || keys[0] != k {
+		t.Error("List did not return the single stored key", keys, err)
+		return
+	}
+	backend.Datastore.Delete(k)
+	if _, ok := ds.Get(k); ok {
+		t.Error("Remote delete did not reach the server's datastore")
+		return
+	}
+}
+
+func TestServerMaxRecordSize(t *testing.T) {
+	ts, ds, backend := remoteTestServer()
+	defer ts.Close()
+
+	// a full block fits under the default limit, but not much more does
+	k := uuid.New()
+	if err := backend.Datastore.Set(k, make([]byte, DefaultBlockSize+1024)); err != nil {
+		t.Error("Server rejected a full block", err)
+		return
+	}
+	if err := backend.Datastore.Set(k, make([]byte, DefaultMaxRecordSize+1)); err == nil {
+		t.Error("Server accepted a record over its limit")
+		return
+	}
+	if v, _ := ds.Get(k); len(v) != DefaultBlockSize+1024 {
+		t.Error("Oversized record replaced the stored one", len(v))
+		return
+	}
+
+	// the limit can be set per server
+	srv := NewServer(NewMemoryDatastore(), NewMemoryKeystore())
+	srv.MaxRecordSize = 16
+	small := httptest.NewServer(srv)
+	defer small.Close()
+	if err := NewRemoteDatastore(small.URL, small.Client()).Set(k, make([]byte, 17)); err == nil {
+		t.Error("Server accepted a record over its configured limit")
+		return
+	}
+}
+
+func TestRemoteUsers(t *testing.T) {
+	ts, ds, backend := remoteTestServer()
+	defer ts.Close()
+
+	// usernames are arbitrary strings, including ones that look like paths
+	alice, err := InitUserWithBackend(backend, "alice/../..", "foo")
+	if err != nil {
+		t.Error("Failed to initialize user against remote server", err)
+		return
+	}
+	if _, err = InitUserWithBackend(backend, "alice/../..", "bar"); err == nil {
+		t.Error("Remote keystore allowed a username to be taken twice")
+		return
+	}
+	bob, err := InitUserWithBackend(backend, "bob", "bar")
+	if err != nil {
+		t.Error("Failed to initialize user against remote server", err)
+		return
+	}
+
+	v := []byte("This is a very secret remote file")
+	alice.StoreFile("secretfilename", v)
+	magic, err := alice.ShareFile("secretfilename", "bob")
+	if err != nil {
+		t.Error("Failed to share file over remote server", err)
+		return
+	}
+	err = bob.ReceiveFile("shared", "alice/../..", magic)
+	if err != nil {
+		t.Error("Failed to receive file over remote server", err)
+		return
+	}
+	v2, err := bob.LoadFile("shared")
+	if err != nil || !reflect.DeepEqual(v, v2) {
+		t.Error("Shared file is not the same over remote server", v2, err)
+		return
+	}
+
+	// the server only ever holds ciphertext
+	keys, _ := ds.List()
+	for _, k := range keys {
+		record, _ := ds.Get(k)
+		if bytes.Contains(record, []byte("secret")) {
+			t.Error("Server saw plaintext in record", k)
+			return
+		}
+	}
+}
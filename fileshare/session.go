@@ -0,0 +1,111 @@
+package proj2
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ******************************************** SESSIONS ********************************* //
+
+// Every call on a User starts by fetching the User struct again, so that
+// changes made by other sessions are seen. Deriving the struct's UUID and
+// keys from the password takes a slowHash and two Argon2Key runs, so they
+// are derived once per login and kept here instead. The fetch itself is
+// still authenticated with the HMAC on every call. The session also
+// remembers the latest Metadata Revision it has read of each file, and how
+// far into each append log it has read, so that an old Metadata record
+// replayed into the datastore, or append records deleted from it, are
+// noticed.
+
+// Keys derived from a user's password for one login. Shared by every copy
+// of the User struct made from that login.
+type userSession struct {
+	mu      sync.Mutex
+	usrUUID uuid.UUID
+	salt    []byte
+	symEnc  []byte
+	symMAC  []byte
+
+	// MetadataUUID -> latest Revision read of it
+	revisions map[uuid.UUID]uint64
+	// append log ID -> index just past the last slot read of it
+	appends map[uuid.UUID]int
+}
+
+// Starts a session for username and password, deriving the UUID of their
+// User struct
+func newUserSession(username string, password string) *userSession {
+	return &userSession{usrUUID: getUserUUID(username, password)}
+}
+
+// Returns the User struct keys for salt, deriving them only if they are not
+// the keys already cached
+func (session *userSession) keys(username string, password string, salt []byte) (symEnc []byte, symMAC []byte) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.salt == nil || !bytes.Equal(session.salt, salt) {
+		session.symEnc, session.symMAC = getUserKeys(username, password, salt)
+		session.salt = append([]byte(nil), salt...)
+	}
+	return session.symEnc, session.symMAC
+}
+
+// Returns the salt and keys to seal the User struct with: those of the
+// struct last read, or fresh ones if nothing has been read yet
+func (session *userSession) sealKeys(username string, password string) (salt []byte, symEnc []byte, symMAC []byte) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.salt == nil {
+		session.salt = userlib.RandomBytes(40)
+		session.symEnc, session.symMAC = getUserKeys(username, password, session.salt)
+	}
+	return session.salt, session.symEnc, session.symMAC
+}
+
+// Records that the Metadata at metadataUUID was read at revision. Reports
+// false if the session has already read a later revision, in which case an
+// old record has been replayed. A nil session has seen nothing.
+func (session *userSession) sawRevision(metadataUUID uuid.UUID, revision uint64) bool {
+	if session == nil {
+		return true
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if revision < session.revisions[metadataUUID] {
+		return false
+	}
+	if session.revisions == nil {
+		session.revisions = make(map[uuid.UUID]uint64)
+	}
+	session.revisions[metadataUUID] = revision
+	return true
+}
+
+// Records that the append log logID was read up to length slots. Reports
+// false if the session has already read further, in which case records
+// have been deleted from the log. A nil session has seen nothing.
+func (session *userSession) sawAppends(logID uuid.UUID, length int) bool {
+	if session == nil {
+		return true
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if length < session.appends[logID] {
+		return false
+	}
+	if session.appends == nil {
+		session.appends = make(map[uuid.UUID]int)
+	}
+	session.appends[logID] = length
+	return true
+}
+
+// Fetches the current User struct of usr's user with the keys cached for
+// usr's session
+func refreshUser(usr *User) (userdataptr *User, err error) {
+	userdataptr, _, err = getUserRaw(usr.backend, usr.Username, usr.password, usr.session)
+	return userdataptr, err
+}
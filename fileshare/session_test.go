@@ -0,0 +1,90 @@
+package proj2
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cs161-staff/userlib"
+)
+
+func TestSessionKeys(t *testing.T) {
+	store := NewMemoryDatastore()
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	session := alice.session
+	alice.StoreFile("file1", []byte("contents"))
+	alice.AppendFile("file1", []byte(" and more"))
+
+	// the User struct is re-posted under the salt the session already has keys for
+	val, _ := store.Get(getUserUUID("alice", "foo"))
+	if !bytes.Equal(val[userlib.HashSize:userlib.HashSize+40], session.salt) {
+		t.Error("User struct was sealed with a salt the session did not cache")
+		return
+	}
+	if fresh, err := refreshUser(alice); err != nil || fresh.session != session {
+		t.Error("Refreshing the User struct did not reuse the session", err)
+		return
+	}
+
+	// a second login derives its own keys and sees the first one's changes
+	alice2, err := GetUserWithBackend(backend, "alice", "foo")
+	if err != nil || alice2.session == session {
+		t.Error("Second login shared the first one's session", err)
+		return
+	}
+	alice2.StoreFile("file2", []byte("from the second login"))
+	if !checkContents(t, alice, "file2", []byte("from the second login")) {
+		return
+	}
+
+	// the cheap fetch is still authenticated
+	val, _ = store.Get(getUserUUID("alice", "foo"))
+	val[len(val)-1] ^= 1
+	store.Set(getUserUUID("alice", "foo"), val)
+	if _, err = alice.LoadFile("file1"); err == nil {
+		t.Error("Loaded a file through a tampered User struct")
+		return
+	}
+}
+
+func TestSessionRevisions(t *testing.T) {
+	store := NewMemoryDatastore()
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	alice.StoreFile("file1", []byte("first"))
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	old, _ := store.Get(metadata.MetadataUUID)
+	alice.StoreFile("file1", []byte("second"))
+	if !checkContents(t, alice, "file1", []byte("second")) {
+		return
+	}
+
+	// the session has read a later revision than the one put back
+	store.Set(metadata.MetadataUUID, old)
+	if _, err := alice.LoadFile("file1"); err == nil {
+		t.Error("Loaded a file whose Metadata was rolled back")
+		return
+	}
+}
+
+func TestSessionAppends(t *testing.T) {
+	store := NewMemoryDatastore()
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	alice.StoreFile("file1", []byte("first;"))
+	alice.AppendFile("file1", []byte("second;"))
+	alice.AppendFile("file1", []byte("third;"))
+	if !checkContents(t, alice, "file1", []byte("first;second;third;")) {
+		return
+	}
+
+	// the session has read further into the log than is left
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	store.Delete(appendSlot(appendLogID(metadata), 1))
+	if _, err := alice.LoadFile("file1"); err == nil {
+		t.Error("Loaded a file whose append log was truncated")
+		return
+	}
+}
@@ -0,0 +1,423 @@
+package proj2
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ****************************************** SNAPSHOTS ********************************** //
+
+// The structure definition for where a snapshot record is kept and the
+// keys it is encrypted and authenticated under; kept in the User struct
+type SnapshotRef struct {
+	SnapshotUUID uuid.UUID
+	EncKey       []byte
+	MACKey       []byte
+}
+
+// The structure definition for a Snapshot record: a user's namespace and
+// the contents of every file they owned at one point in time
+type Snapshot struct {
+	Label    string
+	Created  int64 // Unix nanoseconds
+	UUIDMap  map[string]uuid.UUID
+	OwnerMap map[string]string
+	NameMap  map[string]string
+	Files    map[string]Version // filename hash -> contents of an owned file
+}
+
+// The structure definition for what ListSnapshots reports about a snapshot
+type SnapshotInfo struct {
+	Label   string
+	Created time.Time
+	Files   int // number of files in the snapshot's namespace
+}
+
+// Retrieve the Snapshot record a SnapshotRef points to
+func getSnapshot(usr User, ref SnapshotRef) (snapshot Snapshot, err error) {
+	// variable declarations
+	var ok bool
+	var plaintext, ciphertext, authStore, authCompute, val []byte
+
+	// retrieve from datastore and split val into components
+	val, ok = usr.backend.Datastore.Get(ref.SnapshotUUID)
+	if !ok {
+		userlib.DebugMsg("snapshot is not at recorded UUID")
+		return snapshot, errors.New(strings.ToTitle("snapshot is not at recorded UUID"))
+	}
+	if len(val) < userlib.HashSize {
+		userlib.DebugMsg("snapshot was corrupted in datastore (not enough info)")
+		return snapshot, errors.New(strings.ToTitle("snapshot was corrupted in datastore (not enough info)"))
+	}
+	authStore = val[:userlib.HashSize]
+	ciphertext = val[userlib.HashSize:]
+
+	// verify, decrypt, and unmarshal snapshot
+	authCompute, err = userlib.HMACEval(ref.MACKey, ciphertext)
+	if err != nil {
+		userlib.DebugMsg("error computing HMAC of ciphertext for snapshot")
+		return snapshot, err
+	}
+	if !userlib.HMACEqual(authStore, authCompute) {
+		userlib.DebugMsg("cannot verify snapshot")
+		return snapshot, errors.New(strings.ToTitle("cannot verify snapshot"))
+	}
+	if len(ciphertext)%userlib.AESBlockSize != 0 || len(ciphertext) < 2*userlib.AESBlockSize {
+		userlib.DebugMsg("ciphertext is not a multiple of the block size!")
+		return snapshot, errors.New(strings.ToTitle("ciphertext is not a multiple of the block size!"))
+	}
+	plaintext = userlib.SymDec(ref.EncKey, ciphertext)
+	plaintext = unpad(plaintext)
+	err = json.Unmarshal(plaintext, &snapshot)
+	if err != nil {
+		userlib.DebugMsg("error unmarshalling snapshot")
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+// Adds or removes (if version is nil) the pin a snapshot holds on the file
+// under filenameHash, and re-posts its metadata. Returns the metadata as
+// posted and, when unpinning, the blocks that may no longer be needed.
+func setPin(usr User, filenameHash string, pinID string, version *Version) (metadata Metadata, released []uuid.UUID, err error) {
+	metadata, _, err = updateMetadata(usr, filenameHash, func(metadata *Metadata) error {
+		released = nil
+		if version == nil {
+			released = metadata.Pins[pinID].TextList
+			delete(metadata.Pins, pinID)
+		} else {
+			if metadata.Pins == nil {
+				metadata.Pins = make(map[string]Version)
+			}
+			metadata.Pins[pinID] = *version
+		}
+		metadata.LastModified = usr.Username
+		return nil
+	})
+	if err != nil {
+		userlib.DebugMsg("error updating file metadata")
+		return metadata, nil, err
+	}
+	return metadata, released, nil
+}
+
+// Makes the contents pinned under pinID the current contents of the owned
+// file under filenameHash, starting over if another writer changes the file
+// first. The blocks are taken from the pin rather than the snapshot record,
+// since revocation moves them.
+func restoreSnapshotFile(usr User, filenameHash string, pinID string) (err error) {
+	var metadata Metadata
+	var version Version
+	var raw, metadataKey []byte
+	var superseded, copied []uuid.UUID
+	var ok bool
+
+	return retryOnConflict(func() (err error) {
+		metadata, metadataKey, raw, err = verifyFileAccessRaw(usr, filenameHash)
+		if err != nil {
+			return err
+		}
+		if version, ok = metadata.Pins[pinID]; !ok {
+			userlib.DebugMsg("file no longer holds the snapshot's contents")
+			return errors.New(strings.ToTitle("snapshot contents of file are missing"))
+		}
+		if sameBlocks(metadata.TextList, version.TextList) {
+			return nil
+		}
+
+		superseded, copied, err = restoreContents(usr, &metadata, version)
+		if err != nil {
+			return err
+		}
+		err = postMetadataCAS(usr, &metadata, metadataKey, raw)
+		if err != nil {
+			userlib.DebugMsg("error posting file metadata")
+			deleteText(usr, copied)
+			return err
+		}
+		return releaseText(usr, metadata, superseded)
+	})
+}
+
+// Reports whether two block lists are the same
+func sameBlocks(a []uuid.UUID, b []uuid.UUID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Records this user's namespace, and the current contents of every file
+// they own, under label. Each owned file's Metadata pins the recorded
+// contents so that later writes, compaction and version retention leave
+// their Text blocks in place until the snapshot is deleted. Received files
+// are recorded in the namespace only; their contents belong to their
+// owners.
+func (usr *User) Snapshot(label string) (err error) {
+	// variable declarations
+	var snapshot Snapshot
+	var ref SnapshotRef
+	var metadata Metadata
+	var version Version
+	var ok bool
+
+	// on failure nothing can reach the snapshot, so take its pins back out
+	var unpin = func() {
+		for filenameHash := range snapshot.Files {
+			if metadata, released, perr := setPin(*usr, filenameHash, ref.SnapshotUUID.String(), nil); perr == nil {
+				releaseText(*usr, metadata, released)
+			}
+		}
+	}
+
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	if _, ok = usr.Snapshots[label]; ok {
+		userlib.DebugMsg("snapshot " + label + " already exists")
+		return errors.New(strings.ToTitle("there is already a snapshot with this label"))
+	}
+
+	ref.SnapshotUUID = uuid.New()
+	ref.EncKey = userlib.RandomBytes(userlib.AESBlockSize)
+	ref.MACKey = userlib.RandomBytes(userlib.AESBlockSize)
+	snapshot.Label = label
+	snapshot.Created = time.Now().UnixNano()
+	snapshot.UUIDMap = make(map[string]uuid.UUID)
+	snapshot.OwnerMap = make(map[string]string)
+	snapshot.NameMap = make(map[string]string)
+	snapshot.Files = make(map[string]Version)
+
+	// record the namespace, pinning the contents of owned files
+	for filenameHash, sentinelUUID := range usr.UUIDMap {
+		metadata, _, err = verifyFileAccess(*usr, filenameHash)
+		if err != nil {
+			continue
+		}
+		snapshot.UUIDMap[filenameHash] = sentinelUUID
+		snapshot.OwnerMap[filenameHash] = usr.OwnerMap[filenameHash]
+		snapshot.NameMap[filenameHash] = usr.NameMap[filenameHash]
+		if metadata.Owner != usr.Username {
+			continue
+		}
+		version = Version{
+			Number:       metadata.VersionNumber,
+			TextList:     metadata.TextList,
+			TextLengths:  metadata.TextLengths,
+			Compression:  metadata.Compression,
+			LastModified: metadata.LastModified,
+			ModTime:      metadata.ModTime,
+		}
+		_, _, err = setPin(*usr, filenameHash, ref.SnapshotUUID.String(), &version)
+		if err != nil {
+			unpin()
+			return err
+		}
+		snapshot.Files[filenameHash] = version
+	}
+
+	// post the snapshot, then make it reachable from the user struct
+	err = postStruct(snapshot, ref.SnapshotUUID, ref.EncKey, ref.MACKey, nil, *usr, false)
+	if err != nil {
+		userlib.DebugMsg("error posting snapshot")
+		unpin()
+		return err
+	}
+	err = updateUser(usr, func(usr *User) error {
+		if _, ok := usr.Snapshots[label]; ok {
+			userlib.DebugMsg("snapshot " + label + " already exists")
+			return errors.New(strings.ToTitle("there is already a snapshot with this label"))
+		}
+		if usr.Snapshots == nil {
+			usr.Snapshots = make(map[string]SnapshotRef)
+		}
+		usr.Snapshots[label] = ref
+		return nil
+	})
+	if err != nil {
+		userlib.DebugMsg("error posting user struct")
+		unpin()
+		usr.backend.Datastore.Delete(ref.SnapshotUUID)
+		return err
+	}
+	return nil
+}
+
+// Lists this user's snapshots, oldest first
+func (usr *User) ListSnapshots() (snapshots []SnapshotInfo, err error) {
+	var snapshot Snapshot
+
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return nil, err
+	}
+
+	snapshots = []SnapshotInfo{}
+	for _, ref := range usr.Snapshots {
+		snapshot, err = getSnapshot(*usr, ref)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, SnapshotInfo{
+			Label:   snapshot.Label,
+			Created: time.Unix(0, snapshot.Created),
+			Files:   len(snapshot.UUIDMap),
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// Rolls this user's namespace back to the snapshot with the given label.
+//
+// Every name in the snapshot points at the file it did then, and every
+// owned file's contents are reset to those recorded. Resetting is a write
+// like StoreFile, so the contents it replaces are kept as a version if the
+// file keeps versions. Names created since the snapshot are left alone,
+// except where the snapshot reuses them. Files that can no longer be
+// reached (deleted by their owner, or access revoked) are left out. Every
+// file is checked before any is written, so if an owned file no longer
+// holds the recorded contents, nothing is restored.
+func (usr *User) RestoreSnapshot(label string) (err error) {
+	// variable declarations
+	var snapshot Snapshot
+	var ref SnapshotRef
+	var metadata Metadata
+	var restored, reset []string
+	var ok bool
+
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	ref, ok = usr.Snapshots[label]
+	if !ok {
+		userlib.DebugMsg("no snapshot " + label)
+		return errors.New(strings.ToTitle("no snapshot with this label"))
+	}
+	snapshot, err = getSnapshot(*usr, ref)
+	if err != nil {
+		return err
+	}
+
+	for filenameHash, sentinelUUID := range snapshot.UUIDMap {
+		prevUUID, hadPrev := usr.UUIDMap[filenameHash]
+		prevOwner, prevName := usr.OwnerMap[filenameHash], usr.NameMap[filenameHash]
+		usr.UUIDMap[filenameHash] = sentinelUUID
+		usr.OwnerMap[filenameHash] = snapshot.OwnerMap[filenameHash]
+		usr.NameMap[filenameHash] = snapshot.NameMap[filenameHash]
+		metadata, _, err = verifyFileAccess(*usr, filenameHash)
+		if err != nil {
+			// keep whatever the name points at now rather than lose it
+			userlib.DebugMsg("file in snapshot can no longer be reached; leaving it out")
+			if hadPrev {
+				usr.UUIDMap[filenameHash] = prevUUID
+				usr.OwnerMap[filenameHash] = prevOwner
+				usr.NameMap[filenameHash] = prevName
+			}
+			continue
+		}
+		restored = append(restored, filenameHash)
+		_, ok = snapshot.Files[filenameHash]
+		if !ok || metadata.Owner != usr.Username {
+			continue
+		}
+		if _, ok = metadata.Pins[ref.SnapshotUUID.String()]; !ok {
+			userlib.DebugMsg("file " + snapshot.NameMap[filenameHash] + " no longer holds the snapshot's contents")
+			return errors.New(strings.ToTitle("snapshot contents of a file are missing; nothing was restored"))
+		}
+		reset = append(reset, filenameHash)
+	}
+
+	// only now reset the owned files' contents
+	for _, filenameHash := range reset {
+		err = restoreSnapshotFile(*usr, filenameHash, ref.SnapshotUUID.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	// point the restored names at their files, leaving every other entry
+	// as other sessions have left it
+	err = updateUser(usr, func(usr *User) error {
+		for _, filenameHash := range restored {
+			usr.UUIDMap[filenameHash] = snapshot.UUIDMap[filenameHash]
+			usr.OwnerMap[filenameHash] = snapshot.OwnerMap[filenameHash]
+			usr.NameMap[filenameHash] = snapshot.NameMap[filenameHash]
+		}
+		return nil
+	})
+	if err != nil {
+		userlib.DebugMsg("error posting user struct")
+		return err
+	}
+	return nil
+}
+
+// Deletes the snapshot with the given label, releasing its pins on the
+// contents of owned files
+func (usr *User) DeleteSnapshot(label string) (err error) {
+	// variable declarations
+	var snapshot Snapshot
+	var ref SnapshotRef
+	var metadata Metadata
+	var released []uuid.UUID
+	var ok bool
+
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	ref, ok = usr.Snapshots[label]
+	if !ok {
+		userlib.DebugMsg("no snapshot " + label)
+		return errors.New(strings.ToTitle("no snapshot with this label"))
+	}
+	snapshot, err = getSnapshot(*usr, ref)
+	if err != nil {
+		return err
+	}
+
+	// files that have since been deleted or renamed away are looked up
+	// through the snapshot's namespace, not the current one
+	for filenameHash := range snapshot.Files {
+		lookup := *usr
+		lookup.UUIDMap = map[string]uuid.UUID{filenameHash: snapshot.UUIDMap[filenameHash]}
+		lookup.OwnerMap = map[string]string{filenameHash: snapshot.OwnerMap[filenameHash]}
+		lookup.NameMap = map[string]string{}
+		metadata, released, err = setPin(lookup, filenameHash, ref.SnapshotUUID.String(), nil)
+		if err != nil {
+			continue
+		}
+		err = releaseText(*usr, metadata, released)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = updateUser(usr, func(usr *User) error {
+		delete(usr.Snapshots, label)
+		return nil
+	})
+	if err != nil {
+		userlib.DebugMsg("error posting user struct")
+		return err
+	}
+	return usr.backend.Datastore.Delete(ref.SnapshotUUID)
+}
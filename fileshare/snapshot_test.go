@@ -0,0 +1,136 @@
+package proj2
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSnapshots(t *testing.T) {
+	store := NewMemoryDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	bob, _ := InitUserWithBackend(alice.backend, "bob", "bar")
+
+	alice.StoreFile("file1", []byte("file1 contents"))
+	alice.AppendFile("file1", []byte(", appended"))
+	alice.StoreFile("file2", []byte("file2 contents"))
+	bob.StoreFile("bobfile", []byte("bob's contents"))
+	magic, _ := bob.ShareFile("bobfile", "alice")
+	alice.ReceiveFile("from bob", "bob", magic)
+
+	if err := alice.Snapshot("before"); err != nil {
+		t.Error("Failed to take snapshot", err)
+		return
+	}
+	if err := alice.Snapshot("before"); err == nil {
+		t.Error("Took two snapshots with the same label")
+		return
+	}
+	snapshots, err := alice.ListSnapshots()
+	if err != nil || len(snapshots) != 1 || snapshots[0].Label != "before" || snapshots[0].Files != 3 {
+		t.Error("Snapshot listing is wrong", snapshots, err)
+		return
+	}
+
+	// the accidents: overwrites, compaction and a recreated name
+	alice.StoreFile("file1", []byte("oops"))
+	alice.AppendFile("file2", []byte(" and more"))
+	alice.CompactFile("file2", 0)
+	alice.StoreFile("file3", []byte("made after the snapshot"))
+	bob.StoreFile("bobfile", []byte("bob's new contents"))
+	keys, _ := store.List()
+	before := len(keys)
+
+	if err = alice.RestoreSnapshot("nonexistent"); err == nil {
+		t.Error("Restored a snapshot that does not exist")
+		return
+	}
+	if err = alice.RestoreSnapshot("before"); err != nil {
+		t.Error("Failed to restore snapshot", err)
+		return
+	}
+	checkContents(t, alice, "file1", []byte("file1 contents, appended"))
+	checkContents(t, alice, "file2", []byte("file2 contents"))
+	checkContents(t, alice, "file3", []byte("made after the snapshot"))
+	checkContents(t, alice, "from bob", []byte("bob's new contents"))
+	keys, _ = store.List()
+	if len(keys) != before-2 {
+		t.Error("Restoring did not delete the contents it replaced", before, len(keys))
+		return
+	}
+
+	// a second session sees the restored files and can keep editing them
+	alice2, _ := GetUserWithBackend(alice.backend, "alice", "foo")
+	alice2.AppendFile("file1", []byte(", after restore"))
+	checkContents(t, alice, "file1", []byte("file1 contents, appended, after restore"))
+
+	// deleting the snapshot releases its pins and its record
+	if err = alice.DeleteSnapshot("before"); err != nil {
+		t.Error("Failed to delete snapshot", err)
+		return
+	}
+	if snapshots, _ = alice.ListSnapshots(); len(snapshots) != 0 {
+		t.Error("Deleted snapshot is still listed", snapshots)
+		return
+	}
+	alice2, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice2, getFilenameHash("file1", "alice"))
+	if len(metadata.Pins) != 0 {
+		t.Error("Deleted snapshot still pins file contents")
+		return
+	}
+	checkContents(t, alice, "file1", []byte("file1 contents, appended, after restore"))
+	if err = alice.RestoreSnapshot("before"); err == nil {
+		t.Error("Restored a deleted snapshot")
+		return
+	}
+}
+
+func TestSnapshotFailureUnpins(t *testing.T) {
+	store := &failingDatastore{Datastore: NewMemoryDatastore()}
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	alice.StoreFile("file1", []byte("file1 contents"))
+	alice.StoreFile("file2", []byte("file2 contents"))
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+
+	// pinning rewrites existing Metadata; only posting the new snapshot fails
+	store.mu.Lock()
+	store.fail = func(key uuid.UUID) bool {
+		_, ok := store.Datastore.Get(key)
+		return !ok
+	}
+	store.mu.Unlock()
+	if err := alice.Snapshot("broken"); err == nil {
+		t.Error("Snapshot succeeded although it could not be posted")
+		return
+	}
+	store.disarm()
+
+	for _, name := range []string{"file1", "file2"} {
+		metadata, _, err := verifyFileAccess(*alice, getFilenameHash(name, "alice"))
+		if err != nil || len(metadata.Pins) != 0 {
+			t.Error("Failed snapshot left its pin on "+name, err, len(metadata.Pins))
+			return
+		}
+	}
+}
+
+func TestRestoreSnapshotAllOrNothing(t *testing.T) {
+	store := NewMemoryDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	alice.StoreFile("file1", []byte("file1 contents"))
+	alice.StoreFile("file2", []byte("file2 contents"))
+	alice.Snapshot("before")
+	alice.StoreFile("file1", []byte("file1 changed"))
+	alice.StoreFile("file2", []byte("file2 changed"))
+
+	// one file lost the contents the snapshot pinned
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	setPin(*alice, getFilenameHash("file2", "alice"), alice.Snapshots["before"].SnapshotUUID.String(), nil)
+	if err := alice.RestoreSnapshot("before"); err == nil {
+		t.Error("Restored a snapshot whose contents are missing")
+		return
+	}
+	checkContents(t, alice, "file1", []byte("file1 changed"))
+	checkContents(t, alice, "file2", []byte("file2 changed"))
+}
@@ -0,0 +1,64 @@
+package proj2
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cs161-staff/userlib"
+)
+
+// ********************************************* STAT ************************************ //
+
+// The structure definition for what StatFile reports about a file
+type FileInfo struct {
+	Name           string    // the name this user knows the file by
+	Size           int64     // total plaintext length, or -1 if the file predates recorded block lengths
+	Owner          string    // the user who created the file
+	LastModifiedBy string    // the user who last signed the file metadata or appended to the file
+	Blocks         int       // number of Text blocks the file is stored in
+	ModTime        time.Time // when the contents last changed; zero if never recorded
+}
+
+// Records in metadata that the file contents changed just now
+func markModified(metadata *Metadata) {
+	metadata.ModTime = time.Now().UnixNano()
+}
+
+// Describes a file without downloading any of its contents. Everything
+// reported comes from the file's verified Metadata; no Text blocks are
+// fetched.
+func (usr *User) StatFile(filename string) (info FileInfo, err error) {
+	// variable declarations
+	var metadata Metadata
+	var filenameHash string
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return info, err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	metadata, _, err = verifyFileAccess(*usr, filenameHash)
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return info, errors.New(strings.ToTitle("could not verify that user has access to filename"))
+	}
+
+	info.Name = filename
+	info.Owner = metadata.Owner
+	info.LastModifiedBy = metadata.LastModified
+	info.Blocks = len(metadata.TextList)
+	if len(metadata.TextLengths) == len(metadata.TextList) {
+		for _, l := range metadata.TextLengths {
+			info.Size += int64(l)
+		}
+	} else {
+		info.Size = -1
+	}
+	if metadata.ModTime != 0 {
+		info.ModTime = time.Unix(0, metadata.ModTime)
+	}
+	return info, nil
+}
@@ -0,0 +1,55 @@
+package proj2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatFile(t *testing.T) {
+	store := newCountingDatastore()
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	bob, _ := InitUserWithBackend(backend, "bob", "bar")
+
+	start := time.Now()
+	alice.StoreFile("file1", []byte("0123456789"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+	bob.AppendFile("shared", []byte("abcde"))
+
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	store.reset()
+	info, err := alice.StatFile("file1")
+	if err != nil {
+		t.Error("Failed to stat file", err)
+		return
+	}
+	for _, textUUID := range metadata.TextList {
+		if store.fetched[textUUID] != 0 {
+			t.Error("StatFile fetched a text block")
+			return
+		}
+	}
+	if info.Name != "file1" || info.Size != 15 || info.Owner != "alice" || info.LastModifiedBy != "bob" || info.Blocks != 2 {
+		t.Error("StatFile reported the wrong file info", info)
+		return
+	}
+	if info.ModTime.Before(start) || info.ModTime.After(time.Now()) {
+		t.Error("StatFile reported an implausible modification time", info.ModTime)
+		return
+	}
+
+	// sharing re-signs metadata but does not change the contents
+	modTime := info.ModTime
+	alice.ShareFile("file1", "bob")
+	info, _ = bob.StatFile("shared")
+	if !info.ModTime.Equal(modTime) {
+		t.Error("Sharing changed the file's modification time")
+		return
+	}
+	if _, err = alice.StatFile("nonexistent"); err == nil {
+		t.Error("Stat'ed a nonexistent file")
+		return
+	}
+}
@@ -0,0 +1,187 @@
+package proj2
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ******************************************* STREAMING ********************************* //
+
+// Largest Text block OpenAppender (and anything else that cuts a stream
+// into blocks) will post
+const DefaultBlockSize = 1 << 20
+
+// Returned by fileAppender.Write and Close if the file's block keys or codec
+// changed while the appender was open. Blocks posted before the change are
+// kept.
+var errStreamRekeyed = errors.New(strings.ToTitle("file was re-keyed during append"))
+
+// The structure definition for a reader over the Text blocks of one file
+type fileReader struct {
+	usr      User
+	metadata Metadata
+	next     int    // index in metadata.TextList of the next block to fetch
+	buf      []byte // unread data of the current block
+	closed   bool
+}
+
+// Opens a file for streaming reads. Text blocks are fetched, verified and
+// decrypted one at a time as the reader reaches them, so memory use is
+// bounded by the largest block rather than the file size. The reader reads
+// the blocks the file had when OpenReader was called, and sees nothing
+// appended later. A StoreFile, WriteAt, CompactFile, SetCompression or
+// RevokeFile that lands meanwhile deletes the blocks it replaces, so a Read
+// that reaches one of them fails.
+func (usr *User) OpenReader(filename string) (reader io.ReadCloser, err error) {
+	// variable declarations
+	var metadata Metadata
+	var filenameHash string
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return nil, err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	metadata, _, err = verifyFileAccess(*usr, filenameHash)
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return nil, errors.New(strings.ToTitle("could not verify that user has access to filename"))
+	}
+
+	return &fileReader{usr: *usr, metadata: metadata}, nil
+}
+
+func (r *fileReader) Read(p []byte) (n int, err error) {
+	var text Text
+
+	if r.closed {
+		return 0, errors.New(strings.ToTitle("read from closed file reader"))
+	}
+	for len(r.buf) == 0 {
+		if r.next >= len(r.metadata.TextList) {
+			return 0, io.EOF
+		}
+		text, err = getText(r.usr, r.metadata, r.metadata.TextList[r.next])
+		if err != nil {
+			return 0, err
+		}
+		r.buf = text.Data
+		r.next++
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *fileReader) Close() error {
+	r.closed = true
+	r.buf = nil
+	return nil
+}
+
+// The structure definition for a writer that appends Text blocks to one file
+type fileAppender struct {
+	usr         User
+	metadata    Metadata // as read when opened, moved past each record the appender posts
+	metadataKey []byte
+	buf         []byte // data not yet cut into a block
+	closed      bool
+}
+
+// Opens a file for streaming appends. Written data is cut into Text blocks
+// of DefaultBlockSize which are posted as soon as they fill, so memory use
+// is bounded by the block size. Each block is linked into the file through
+// the append log as it is posted, as by AppendFile, and so becomes visible
+// to readers at once; Metadata is never re-posted.
+func (usr *User) OpenAppender(filename string) (writer io.WriteCloser, err error) {
+	// variable declarations
+	var metadata Metadata
+	var metadataKey []byte
+	var filenameHash string
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return nil, err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	metadata, metadataKey, err = verifyFileAccess(*usr, filenameHash)
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return nil, errors.New(strings.ToTitle("could not verify that user has access to file"))
+	}
+
+	return &fileAppender{usr: *usr, metadata: metadata, metadataKey: metadataKey}, nil
+}
+
+// Posts data as a new Text block and claims the next append log slot for it
+func (w *fileAppender) postBlock(data []byte) (err error) {
+	var text Text
+	var index int
+
+	text.TextUUID = uuid.New()
+	text.Data = data
+	err = postText(w.usr, text, w.metadata)
+	if err != nil {
+		return err
+	}
+	index, err = postAppendRecord(w.usr, w.metadata, w.metadataKey, newAppendRecord(w.usr, w.metadata, text.TextUUID, len(data)))
+	if err != nil {
+		deleteText(w.usr, []uuid.UUID{text.TextUUID})
+		if err == errMetadataConflict {
+			userlib.DebugMsg("file was re-keyed or re-encoded while streaming")
+			return errStreamRekeyed
+		}
+		return err
+	}
+	w.metadata.AppendsFolded = index + 1
+	return nil
+}
+
+func (w *fileAppender) Write(p []byte) (n int, err error) {
+	var chunk int
+
+	if w.closed {
+		return 0, errors.New(strings.ToTitle("write to closed file appender"))
+	}
+	for len(p) > 0 {
+		chunk = DefaultBlockSize - len(w.buf)
+		if chunk > len(p) {
+			chunk = len(p)
+		}
+		w.buf = append(w.buf, p[:chunk]...)
+		p = p[chunk:]
+		n += chunk
+		if len(w.buf) == DefaultBlockSize {
+			err = w.postBlock(w.buf)
+			if err != nil {
+				return n, err
+			}
+			w.buf = nil
+		}
+	}
+	return n, nil
+}
+
+// Posts any buffered data as a last block
+func (w *fileAppender) Close() (err error) {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if len(w.buf) > 0 {
+		err = w.postBlock(w.buf)
+		if err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+	return nil
+}
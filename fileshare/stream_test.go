@@ -0,0 +1,98 @@
+package proj2
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestStreamAppendAndRead(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	bob, _ := InitUser("bob", "bar")
+	alice.StoreFile("file1", []byte("header\n"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+
+	// stream a little over two blocks in awkwardly sized writes
+	payload := []byte(randomString(2*DefaultBlockSize + 123))
+	w, err := bob.OpenAppender("shared")
+	if err != nil {
+		t.Error("Failed to open appender", err)
+		return
+	}
+	_, err = io.CopyBuffer(w, bytes.NewReader(payload), make([]byte, 4099))
+	if err != nil {
+		t.Error("Failed to stream data", err)
+		return
+	}
+
+	// full blocks are visible as soon as they are posted
+	if v, _ := alice.LoadFile("file1"); !bytes.Equal(v, append([]byte("header\n"), payload[:2*DefaultBlockSize]...)) {
+		t.Error("Streamed blocks did not become visible before Close")
+		return
+	}
+	if err = w.Close(); err != nil {
+		t.Error("Failed to close appender", err)
+		return
+	}
+	if _, err = w.Write([]byte("more")); err == nil {
+		t.Error("Wrote to a closed appender")
+		return
+	}
+
+	expected := append([]byte("header\n"), payload...)
+	v, err := alice.LoadFile("file1")
+	if err != nil || !bytes.Equal(v, expected) {
+		t.Error("Loaded file does not match streamed data", err)
+		return
+	}
+	alice, _ = GetUser("alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if len(metadata.TextList) != 4 {
+		t.Error("Appender did not cut the stream into blocks", len(metadata.TextList))
+		return
+	}
+
+	r, err := alice.OpenReader("file1")
+	if err != nil {
+		t.Error("Failed to open reader", err)
+		return
+	}
+	if err = iotest.TestReader(r, expected); err != nil {
+		t.Error("Streaming reader misbehaved", err)
+		return
+	}
+	r.Close()
+	if _, err = alice.OpenReader("nonexistent"); err == nil {
+		t.Error("Opened a reader on a nonexistent file")
+		return
+	}
+}
+
+func TestStreamReaderDetectsTampering(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	alice.StoreFile("file1", []byte("first block"))
+	alice.AppendFile("file1", []byte("second block"))
+	r, _ := alice.OpenReader("file1")
+
+	// corrupt the second block after the reader was opened
+	alice, _ = GetUser("alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	alice.backend.Datastore.Set(metadata.TextList[1], []byte("garbage garbage garbage garbage garbage garbage garbage garbage garbage"))
+
+	buf := make([]byte, 100)
+	n, err := r.Read(buf)
+	if err != nil || string(buf[:n]) != "first block" {
+		t.Error("Failed to read the intact first block", err)
+		return
+	}
+	if _, err = r.Read(buf); err == nil || err == io.EOF {
+		t.Error("Reader did not detect a tampered block", err)
+		return
+	}
+}
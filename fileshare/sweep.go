@@ -0,0 +1,206 @@
+package proj2
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ************************************** MARK AND SWEEP ********************************* //
+
+// The live roots of a datastore, as known to an operator
+type SweepRoots struct {
+	// username -> password of users whose records are traced in full: the
+	// User record, its Snapshot records, and the Sentinel, Metadata and Text
+	// blocks, append log and any revocation journal of every file in their
+	// namespace
+	Credentials map[string]string
+
+	// User record UUIDs (see getUserUUID) of users whose password is not
+	// known. These records are kept, but nothing they point to can be
+	// traced because it is encrypted under the user's password.
+	UserUUIDs []uuid.UUID
+}
+
+// The result of a mark-and-sweep pass
+type SweepReport struct {
+	Reachable   int         // records reached from the roots
+	Unreachable []uuid.UUID // records no root reaches, sorted
+	Deleted     int         // how many of Unreachable were deleted
+
+	// Sentinel or Metadata records of files in some root's namespace that
+	// no root could read, sorted. Their Text blocks cannot be told apart
+	// from garbage and are among Unreachable.
+	Untraced []uuid.UUID
+}
+
+// A Datastore that reads through getChecked and remembers the first read
+// that failed, so that a record that could not be read is never taken for
+// one that is missing
+type sweepDatastore struct {
+	Datastore
+	mu  sync.Mutex
+	err error
+}
+
+func (store *sweepDatastore) Get(key uuid.UUID) (value []byte, ok bool) {
+	var err error
+
+	value, ok, err = getChecked(store.Datastore, key)
+	if err != nil {
+		userlib.DebugMsg("error reading datastore record " + key.String() + ": " + err.Error())
+		store.mu.Lock()
+		if store.err == nil {
+			store.err = err
+		}
+		store.mu.Unlock()
+		return nil, false
+	}
+	return value, ok
+}
+
+// Marks every datastore record reachable from roots and reports (and, if
+// del is true, deletes) every record that is not.
+//
+// Deleting is only allowed when every root is traced in full, i.e. roots
+// has no UserUUIDs and every file in a traced namespace could be read by
+// some root: records referenced from an untraceable User record or file
+// look just like garbage. Users missing from roots lose all their records,
+// so roots must name every live user, and no client should be writing
+// while the sweep runs. If any record cannot be read, e.g. because a
+// RemoteDatastore request failed, nothing is reported or deleted.
+func MarkAndSweep(backend Backend, roots SweepRoots, del bool) (report SweepReport, err error) {
+	// variable declarations
+	var store *sweepDatastore
+	var usr *User
+	var sentinel Sentinel
+	var metadata Metadata
+	var metadataKey []byte
+	var keys []uuid.UUID
+	var marked, traced, untraced map[uuid.UUID]bool
+
+	backend = backend.withDefaults()
+	store = &sweepDatastore{Datastore: backend.Datastore}
+	backend.Datastore = store
+	if del && len(roots.UserUUIDs) > 0 {
+		return report, errors.New(strings.ToTitle("cannot delete with untraceable roots"))
+	}
+
+	// mark
+	marked = make(map[uuid.UUID]bool)
+	traced = make(map[uuid.UUID]bool)
+	untraced = make(map[uuid.UUID]bool)
+	for _, userUUID := range roots.UserUUIDs {
+		marked[userUUID] = true
+	}
+	for username, password := range roots.Credentials {
+		usr, err = GetUserWithBackend(backend, username, password)
+		if err != nil {
+			userlib.DebugMsg("could not log in as " + username + " to trace its files")
+			return report, err
+		}
+		marked[getUserUUID(username, password)] = true
+		for _, ref := range usr.Snapshots {
+			marked[ref.SnapshotUUID] = true
+		}
+		for filenameHash, sentinelUUID := range usr.UUIDMap {
+			marked[sentinelUUID] = true
+			sentinel, err = getSentinel(*usr, sentinelUUID)
+			if err != nil {
+				// a file that was deleted has nothing left to trace
+				if _, ok := backend.Datastore.Get(sentinelUUID); ok {
+					untraced[sentinelUUID] = true
+				}
+				continue
+			}
+			// keep the metadata even if this user can no longer read it
+			marked[sentinel.MetadataUUID] = true
+			// and a revocation in progress, with the blocks it copies and their copies
+			if _, ok := backend.Datastore.Get(revokeJournalUUID(sentinel.MetadataUUID)); ok {
+				marked[revokeJournalUUID(sentinel.MetadataUUID)] = true
+			}
+			journal, journaled, _ := getRevokeJournal(*usr, sentinel.MetadataUUID)
+			for textUUID, copied := range journal.Blocks {
+				marked[textUUID] = true
+				marked[copied] = true
+			}
+			// a revoked user cannot read the file, but its other users may
+			metadata, metadataKey, _, err = verifyFileAccessHelper(*usr, filenameHash)
+			if err != nil && journaled && journal.Blocks != nil {
+				// an interrupted revocation may have posted Metadata under its new key
+				metadataKey = journal.MetadataKey
+				metadata, _, err = getMetadata(*usr, sentinel.MetadataUUID, metadataKey)
+			}
+			if err == nil {
+				_, err = followAppends(*usr, &metadata, metadataKey)
+			}
+			if err != nil {
+				untraced[sentinel.MetadataUUID] = true
+				continue
+			}
+			traced[sentinel.MetadataUUID] = true
+			for textUUID := range referencedText(metadata) {
+				marked[textUUID] = true
+			}
+			for _, logID := range appendLogIDs(metadata) {
+				for i := 0; ; i++ {
+					if _, ok := backend.Datastore.Get(appendSlot(logID, i)); !ok {
+						break
+					}
+					marked[appendSlot(logID, i)] = true
+				}
+			}
+		}
+	}
+
+	if store.err != nil {
+		userlib.DebugMsg("some records could not be read; refusing to sweep")
+		return SweepReport{}, store.err
+	}
+
+	for key := range untraced {
+		if !traced[key] {
+			report.Untraced = append(report.Untraced, key)
+		}
+	}
+	sort.Slice(report.Untraced, func(i, j int) bool {
+		return report.Untraced[i].String() < report.Untraced[j].String()
+	})
+
+	// sweep
+	keys, err = backend.Datastore.List()
+	if err != nil {
+		userlib.DebugMsg("error listing datastore")
+		return report, err
+	}
+	for _, key := range keys {
+		if marked[key] {
+			report.Reachable++
+		} else {
+			report.Unreachable = append(report.Unreachable, key)
+		}
+	}
+	sort.Slice(report.Unreachable, func(i, j int) bool {
+		return report.Unreachable[i].String() < report.Unreachable[j].String()
+	})
+	if !del {
+		return report, nil
+	}
+	if len(report.Untraced) > 0 {
+		userlib.DebugMsg("some files could not be traced; refusing to delete")
+		return report, errors.New(strings.ToTitle("cannot delete while some files cannot be traced"))
+	}
+	for _, key := range report.Unreachable {
+		err = backend.Datastore.Delete(key)
+		if err != nil {
+			userlib.DebugMsg("error deleting unreachable record")
+			return report, err
+		}
+		report.Deleted++
+	}
+	return report, nil
+}
@@ -0,0 +1,172 @@
+package proj2
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestMarkAndSweep(t *testing.T) {
+	store := NewMemoryDatastore()
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	bob, _ := InitUserWithBackend(backend, "bob", "bar")
+	InitUserWithBackend(backend, "carol", "baz")
+
+	alice.StoreFile("file1", []byte("shared file"))
+	alice.AppendFile("file1", []byte(", appended"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("from alice", "alice", magic)
+	bob.StoreFile("file2", []byte("bob's file"))
+	magic, _ = alice.ShareFile("file1", "carol")
+	carol, _ := GetUserWithBackend(backend, "carol", "baz")
+	carol.ReceiveFile("from alice", "alice", magic)
+	alice.RevokeFile("file1", "carol")
+
+	// an orphaned block and a stray record
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	orphan := Text{TextUUID: uuid.New(), Data: []byte("orphan")}
+	postText(*alice, orphan, metadata)
+	stray := uuid.New()
+	store.Set(stray, []byte("stray"))
+
+	creds := map[string]string{"alice": "foo", "bob": "bar", "carol": "baz"}
+	report, err := MarkAndSweep(backend, SweepRoots{Credentials: creds}, false)
+	if err != nil {
+		t.Error("Mark and sweep failed", err)
+		return
+	}
+	found := make(map[uuid.UUID]bool)
+	for _, key := range report.Unreachable {
+		found[key] = true
+	}
+	if !found[orphan.TextUUID] || !found[stray] || report.Deleted != 0 {
+		t.Error("Report is missing unreachable records", report)
+		return
+	}
+	if _, ok := store.Get(stray); !ok {
+		t.Error("Report-only sweep deleted a record")
+		return
+	}
+
+	// untraceable roots can be reported on but not swept
+	carolUUID := getUserUUID("carol", "baz")
+	delete(creds, "carol")
+	_, err = MarkAndSweep(backend, SweepRoots{Credentials: creds, UserUUIDs: []uuid.UUID{carolUUID}}, true)
+	if err == nil {
+		t.Error("Swept with untraceable roots")
+		return
+	}
+	report, err = MarkAndSweep(backend, SweepRoots{Credentials: creds, UserUUIDs: []uuid.UUID{carolUUID}}, false)
+	if err != nil {
+		t.Error("Report with untraceable roots failed", err)
+		return
+	}
+	for _, key := range report.Unreachable {
+		if key == carolUUID {
+			t.Error("Untraceable root was reported unreachable")
+			return
+		}
+	}
+
+	// a user left out of the roots loses their records
+	report, err = MarkAndSweep(backend, SweepRoots{Credentials: creds}, true)
+	if err != nil || report.Deleted != len(report.Unreachable) {
+		t.Error("Sweep failed", report, err)
+		return
+	}
+	keys, _ := store.List()
+	if len(keys) != report.Reachable {
+		t.Error("Sweep left unreachable records behind", len(keys), report.Reachable)
+		return
+	}
+	if _, err = GetUserWithBackend(backend, "carol", "baz"); err == nil {
+		t.Error("User left out of the roots survived the sweep")
+		return
+	}
+	checkContents(t, alice, "file1", []byte("shared file, appended"))
+	checkContents(t, bob, "from alice", []byte("shared file, appended"))
+	checkContents(t, bob, "file2", []byte("bob's file"))
+
+	// a second sweep finds nothing more
+	report, err = MarkAndSweep(backend, SweepRoots{Credentials: creds}, true)
+	if err != nil || len(report.Unreachable) != 0 {
+		t.Error("Second sweep found unreachable records", report, err)
+		return
+	}
+}
+
+func TestMarkAndSweepUntraced(t *testing.T) {
+	store := NewMemoryDatastore()
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	alice.StoreFile("file1", []byte("one;"))
+	alice.AppendFile("file1", []byte("two;"))
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+
+	// with its Metadata unreadable, the file's blocks look like garbage
+	val, _ := store.Get(metadata.MetadataUUID)
+	store.Set(metadata.MetadataUUID, append([]byte("x"), val...))
+	creds := map[string]string{"alice": "foo"}
+	report, err := MarkAndSweep(backend, SweepRoots{Credentials: creds}, false)
+	if err != nil || len(report.Untraced) != 1 || report.Untraced[0] != metadata.MetadataUUID {
+		t.Error("Report did not name the untraced file", report.Untraced, err)
+		return
+	}
+	if _, err = MarkAndSweep(backend, SweepRoots{Credentials: creds}, true); err == nil {
+		t.Error("Swept with a file that could not be traced")
+		return
+	}
+	for _, textUUID := range metadata.TextList {
+		if _, ok := store.Get(textUUID); !ok {
+			t.Error("Sweep deleted a block of an untraced file")
+			return
+		}
+	}
+}
+
+// A datastore whose reads of one record fail the way a RemoteDatastore's
+// do when a request does not get through
+type unreachableDatastore struct {
+	*MemoryDatastore
+	down uuid.UUID
+}
+
+func (store *unreachableDatastore) GetChecked(key uuid.UUID) (value []byte, ok bool, err error) {
+	if key == store.down {
+		return nil, false, errors.New("connection refused")
+	}
+	value, ok = store.MemoryDatastore.Get(key)
+	return value, ok, nil
+}
+
+func (store *unreachableDatastore) Get(key uuid.UUID) (value []byte, ok bool) {
+	value, ok, _ = store.GetChecked(key)
+	return value, ok
+}
+
+func TestMarkAndSweepReadError(t *testing.T) {
+	store := &unreachableDatastore{MemoryDatastore: NewMemoryDatastore()}
+	backend := Backend{Datastore: store, Keystore: NewMemoryKeystore()}
+	alice, _ := InitUserWithBackend(backend, "alice", "foo")
+	alice.StoreFile("file1", []byte("one;"))
+	alice, _ = GetUserWithBackend(backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+
+	// a Sentinel that cannot be fetched is not taken for a deleted file
+	store.down = alice.UUIDMap[getFilenameHash("file1", "alice")]
+	report, err := MarkAndSweep(backend, SweepRoots{Credentials: map[string]string{"alice": "foo"}}, true)
+	if err == nil || report.Deleted != 0 {
+		t.Error("Swept despite a failed read", report, err)
+		return
+	}
+	if _, ok := store.MemoryDatastore.Get(metadata.MetadataUUID); !ok {
+		t.Error("Sweep deleted the Metadata of a file it could not read")
+		return
+	}
+	store.down = uuid.Nil
+	checkContents(t, alice, "file1", []byte("one;"))
+}
@@ -0,0 +1,67 @@
+package proj2
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// **************************************** RECORD FORMATS ******************************* //
+
+// Implemented by record types that have a more compact encoding than JSON;
+// postStruct uses it in place of json.Marshal
+type recordMarshaler interface {
+	marshalRecord() ([]byte, error)
+}
+
+// The first plaintext byte of a Text record says how it is encoded. JSON
+// records, which every Text was before the binary format, start with '{'.
+const (
+	textFormatJSON   byte = '{'
+	textFormatBinary byte = 1 // tag | TextUUID (16 bytes) | uvarint len(Data) | Data
+)
+
+// Encodes a Text block in the binary format, which unlike JSON stores Data
+// as raw bytes rather than base64
+func (text Text) marshalRecord() (plaintext []byte, err error) {
+	var length [binary.MaxVarintLen64]byte
+	var n int
+
+	n = binary.PutUvarint(length[:], uint64(len(text.Data)))
+	plaintext = make([]byte, 0, 1+len(text.TextUUID)+n+len(text.Data))
+	plaintext = append(plaintext, textFormatBinary)
+	plaintext = append(plaintext, text.TextUUID[:]...)
+	plaintext = append(plaintext, length[:n]...)
+	plaintext = append(plaintext, text.Data...)
+	return plaintext, nil
+}
+
+// Decodes a Text block in either the binary or the older JSON format
+func unmarshalText(plaintext []byte, text *Text) (err error) {
+	var n int
+	var length uint64
+
+	if len(plaintext) == 0 {
+		return errors.New(strings.ToTitle("empty text record"))
+	}
+	switch plaintext[0] {
+	case textFormatJSON:
+		return json.Unmarshal(plaintext, text)
+	case textFormatBinary:
+		plaintext = plaintext[1:]
+		if len(plaintext) < len(text.TextUUID) {
+			return errors.New(strings.ToTitle("text record is truncated"))
+		}
+		copy(text.TextUUID[:], plaintext)
+		plaintext = plaintext[len(text.TextUUID):]
+		length, n = binary.Uvarint(plaintext)
+		if n <= 0 || length != uint64(len(plaintext)-n) {
+			return errors.New(strings.ToTitle("text record length does not match its data"))
+		}
+		text.Data = append([]byte(nil), plaintext[n:]...)
+		return nil
+	default:
+		return errors.New(strings.ToTitle("unknown text record format"))
+	}
+}
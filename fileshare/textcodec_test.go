@@ -0,0 +1,61 @@
+package proj2
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTextRecordFormat(t *testing.T) {
+	for _, text := range []Text{
+		{TextUUID: uuid.New(), Data: []byte("hello")},
+		{TextUUID: uuid.New(), Data: []byte{}},
+		{TextUUID: uuid.New(), Data: bytes.Repeat([]byte{0xff, 0x00}, 1000)},
+	} {
+		plaintext, _ := text.marshalRecord()
+		asJSON, _ := json.Marshal(text)
+		if len(plaintext) >= len(asJSON) {
+			t.Error("Binary record is not smaller than JSON", len(plaintext), len(asJSON))
+			return
+		}
+		var got Text
+		if err := unmarshalText(plaintext, &got); err != nil || got.TextUUID != text.TextUUID || !bytes.Equal(got.Data, text.Data) {
+			t.Error("Binary record did not round-trip", err)
+			return
+		}
+		if err := unmarshalText(plaintext[:len(plaintext)-1], &got); len(text.Data) > 0 && err == nil {
+			t.Error("Accepted a truncated binary record")
+			return
+		}
+		if err := unmarshalText(append(plaintext, 0), &got); err == nil {
+			t.Error("Accepted a binary record with trailing data")
+			return
+		}
+	}
+	if err := unmarshalText([]byte{7, 1, 2, 3}, &Text{}); err == nil {
+		t.Error("Accepted a record with an unknown format tag")
+		return
+	}
+}
+
+func TestOldJSONTextRecords(t *testing.T) {
+	store := NewMemoryDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	alice.StoreFile("file1", []byte("new format"))
+
+	// splice in a block written the way Text records used to be
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	metadata, metadataKey, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	old := struct {
+		TextUUID uuid.UUID
+		Data     []byte
+	}{uuid.New(), []byte(", old format")}
+	postStruct(old, old.TextUUID, metadata.TextEncKey, metadata.TextMACKey, nil, *alice, false)
+	appendBlock(&metadata, old.TextUUID, len(old.Data))
+	postMetadata(*alice, metadata, metadataKey)
+
+	alice.AppendFile("file1", []byte(", new again"))
+	checkContents(t, alice, "file1", []byte("new format, old format, new again"))
+}
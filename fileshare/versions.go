@@ -0,0 +1,306 @@
+package proj2
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ******************************************* VERSIONS ********************************** //
+
+// The structure definition for an earlier version of a file's contents,
+// kept in the file's Metadata
+type Version struct {
+	Number       int
+	TextList     []uuid.UUID
+	TextLengths  []int
+	Compression  string // codec the version's blocks were written with
+	LastModified string
+	ModTime      int64
+}
+
+// The structure definition for what ListVersions reports about a version
+type VersionInfo struct {
+	Number         int       // pass to LoadFileVersion or RestoreVersion
+	Size           int64     // total plaintext length, or -1 if unknown
+	LastModifiedBy string    // the user who last signed the file metadata while this version was current
+	ModTime        time.Time // when this version was written; zero if never recorded
+}
+
+// Returns every Text block the file refers to, in its current contents, any
+// kept version or any snapshot pin, mapped to the codec the block was written with
+func referencedText(metadata Metadata) (blocks map[uuid.UUID]string) {
+	blocks = make(map[uuid.UUID]string)
+	for _, v := range metadata.Versions {
+		for _, textUUID := range v.TextList {
+			blocks[textUUID] = v.Compression
+		}
+	}
+	for _, v := range metadata.Pins {
+		for _, textUUID := range v.TextList {
+			blocks[textUUID] = v.Compression
+		}
+	}
+	for _, textUUID := range metadata.TextList {
+		blocks[textUUID] = metadata.Compression
+	}
+	return blocks
+}
+
+// Deletes those of the given Text blocks that metadata no longer refers to.
+// Blocks can be shared between the current contents and kept versions, so
+// anything superseded by an edit goes through here rather than deleteText.
+func releaseText(usr User, metadata Metadata, textList []uuid.UUID) (err error) {
+	var live map[uuid.UUID]string
+	var unused []uuid.UUID
+
+	live = referencedText(metadata)
+	for _, textUUID := range textList {
+		if _, ok := live[textUUID]; !ok {
+			unused = append(unused, textUUID)
+		}
+	}
+	return deleteText(usr, unused)
+}
+
+// Drops the oldest versions until at most metadata.KeepVersions remain and
+// returns the blocks they referred to
+func trimVersions(metadata *Metadata) (dropped []uuid.UUID) {
+	for len(metadata.Versions) > metadata.KeepVersions {
+		dropped = append(dropped, metadata.Versions[0].TextList...)
+		metadata.Versions = metadata.Versions[1:]
+	}
+	return dropped
+}
+
+// Called when the file contents are about to be replaced wholesale: keeps
+// the current contents as a version if the file's retention allows, and
+// numbers the contents that replace them. Returns the blocks that may no
+// longer be needed once the new contents are in place.
+func recordVersion(metadata *Metadata) (superseded []uuid.UUID) {
+	if metadata.KeepVersions == 0 || len(metadata.TextList) == 0 {
+		superseded = metadata.TextList
+	} else {
+		metadata.Versions = append(metadata.Versions, Version{
+			Number:       metadata.VersionNumber,
+			TextList:     metadata.TextList,
+			TextLengths:  metadata.TextLengths,
+			Compression:  metadata.Compression,
+			LastModified: metadata.LastModified,
+			ModTime:      metadata.ModTime,
+		})
+	}
+	metadata.VersionNumber++
+	return append(superseded, trimVersions(metadata)...)
+}
+
+// Returns the kept version with the given number
+func findVersion(metadata Metadata, number int) (version Version, err error) {
+	for _, version = range metadata.Versions {
+		if version.Number == number {
+			return version, nil
+		}
+	}
+	return version, errors.New(strings.ToTitle("no version " + strconv.Itoa(number) + " of file"))
+}
+
+// Makes version the current contents described by metadata, as a write by
+// usr. Blocks are shared with version unless they were written under a
+// different codec than the file now uses, in which case they are re-encoded
+// into new blocks, returned as copied so the caller can delete them if it
+// fails to post metadata. Returns the blocks that may no longer be needed
+// once metadata is posted.
+func restoreContents(usr User, metadata *Metadata, version Version) (superseded []uuid.UUID, copied []uuid.UUID, err error) {
+	var old Metadata
+	var text Text
+	var restored []uuid.UUID
+
+	if version.Compression == metadata.Compression {
+		restored = append(restored, version.TextList...)
+	} else {
+		old = *metadata
+		old.Compression = version.Compression
+		for _, textUUID := range version.TextList {
+			text, err = getText(usr, old, textUUID)
+			if err == nil {
+				text.TextUUID = uuid.New()
+				err = postText(usr, text, *metadata)
+			}
+			if err != nil {
+				deleteText(usr, copied)
+				return nil, nil, err
+			}
+			copied = append(copied, text.TextUUID)
+		}
+		restored = copied
+	}
+
+	superseded = recordVersion(metadata)
+	metadata.TextList = restored
+	metadata.TextLengths = append([]int(nil), version.TextLengths...)
+	metadata.LastModified = usr.Username
+	markModified(metadata)
+	return superseded, copied, nil
+}
+
+// Lists the kept earlier versions of a file, oldest first. The current
+// contents are not included.
+func (usr *User) ListVersions(filename string) (versions []VersionInfo, err error) {
+	// variable declarations
+	var metadata Metadata
+	var info VersionInfo
+	var filenameHash string
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return nil, err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	metadata, _, err = verifyFileAccess(*usr, filenameHash)
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return nil, errors.New(strings.ToTitle("could not verify that user has access to file"))
+	}
+	versions = []VersionInfo{}
+	for _, v := range metadata.Versions {
+		info = VersionInfo{Number: v.Number, LastModifiedBy: v.LastModified}
+		if len(v.TextLengths) == len(v.TextList) {
+			for _, l := range v.TextLengths {
+				info.Size += int64(l)
+			}
+		} else {
+			info.Size = -1
+		}
+		if v.ModTime != 0 {
+			info.ModTime = time.Unix(0, v.ModTime)
+		}
+		versions = append(versions, info)
+	}
+	return versions, nil
+}
+
+// Loads the contents of a kept earlier version of a file
+func (usr *User) LoadFileVersion(filename string, number int) (data []byte, err error) {
+	// variable declarations
+	var metadata Metadata
+	var version Version
+	var texts []Text
+	var filenameHash string
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return nil, err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	metadata, _, err = verifyFileAccess(*usr, filenameHash)
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return nil, errors.New(strings.ToTitle("could not verify that user has access to file"))
+	}
+	version, err = findVersion(metadata, number)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Compression = version.Compression
+	texts, err = getTexts(*usr, metadata, version.TextList)
+	if err != nil {
+		userlib.DebugMsg("cannot load text block for version of " + filename)
+		return nil, err
+	}
+	for i := range texts {
+		data = append(data, texts[i].Data...)
+	}
+	return data, nil
+}
+
+// Makes a kept earlier version the current contents of a file. This is a
+// write like StoreFile: the contents being replaced are kept as a version
+// in turn (subject to retention), and the restored version stays in the
+// history. Blocks are shared with the version rather than copied unless the
+// file's compression setting has changed since the version was written.
+func (usr *User) RestoreVersion(filename string, number int) (err error) {
+	// variable declarations
+	var metadata Metadata
+	var version Version
+	var filenameHash string
+	var raw, metadataKey []byte
+	var superseded, copied []uuid.UUID
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+
+	// start over on the current metadata if another writer changes the file first
+	return retryOnConflict(func() (err error) {
+		metadata, metadataKey, raw, err = verifyFileAccessRaw(*usr, filenameHash)
+		if err != nil {
+			userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+			return errors.New(strings.ToTitle("could not verify that user has access to file"))
+		}
+		version, err = findVersion(metadata, number)
+		if err != nil {
+			return err
+		}
+
+		superseded, copied, err = restoreContents(*usr, &metadata, version)
+		if err != nil {
+			return err
+		}
+		err = postMetadataCAS(*usr, &metadata, metadataKey, raw)
+		if err != nil {
+			userlib.DebugMsg("error posting file metadata")
+			deleteText(*usr, copied)
+			return err
+		}
+		return releaseText(*usr, metadata, superseded)
+	})
+}
+
+// Sets how many earlier versions of a file StoreFile and RestoreVersion
+// keep; 0 keeps none. Versions beyond the new limit are dropped, oldest
+// first, and their blocks deleted. The setting lives in the file's
+// Metadata, so it applies to every user of the file.
+func (usr *User) SetVersionRetention(filename string, keep int) (err error) {
+	// variable declarations
+	var metadata Metadata
+	var filenameHash string
+	var dropped []uuid.UUID
+
+	if keep < 0 {
+		return errors.New(strings.ToTitle("negative version retention"))
+	}
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+	metadata, _, err = updateMetadata(*usr, filenameHash, func(metadata *Metadata) error {
+		metadata.KeepVersions = keep
+		dropped = trimVersions(metadata)
+		metadata.LastModified = usr.Username
+		return nil
+	})
+	if err == errMetadataConflict {
+		return err
+	}
+	if err != nil {
+		userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+		return errors.New(strings.ToTitle("could not verify that user has access to file"))
+	}
+	return releaseText(*usr, metadata, dropped)
+}
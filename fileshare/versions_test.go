@@ -0,0 +1,105 @@
+package proj2
+
+import (
+	"testing"
+)
+
+func TestFileVersions(t *testing.T) {
+	store := NewMemoryDatastore()
+	alice, _ := InitUserWithBackend(Backend{Datastore: store, Keystore: NewMemoryKeystore()}, "alice", "foo")
+	bob, _ := InitUserWithBackend(alice.backend, "bob", "bar")
+
+	alice.StoreFile("file1", []byte("v1"))
+	if versions, err := alice.ListVersions("file1"); err != nil || len(versions) != 0 {
+		t.Error("Versions were kept without retention", versions, err)
+		return
+	}
+	if err := alice.SetVersionRetention("file1", 3); err != nil {
+		t.Error("Failed to set version retention", err)
+		return
+	}
+	alice.StoreFile("file1", []byte("v2"))
+	alice.StoreFile("file1", []byte("v3"))
+	alice, _ = GetUserWithBackend(alice.backend, "alice", "foo")
+	metadata, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	v1Blocks := metadata.Versions[0].TextList
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+	alice.StoreFile("file1", []byte("v4, by alice"))
+	bob.StoreFile("shared", []byte("v5"))
+
+	// the oldest version fell out of retention and its blocks went with it
+	versions, err := bob.ListVersions("shared")
+	if err != nil || len(versions) != 3 {
+		t.Error("Wrong number of versions kept", versions, err)
+		return
+	}
+	for i, n := range []int{2, 3, 4} {
+		if versions[i].Number != n {
+			t.Error("Versions are not listed oldest first", versions)
+			return
+		}
+	}
+	if versions[2].LastModifiedBy != "alice" || versions[2].Size != int64(len("v4, by alice")) || versions[2].ModTime.IsZero() {
+		t.Error("Version info is wrong", versions[2])
+		return
+	}
+	if _, err = alice.LoadFileVersion("file1", 1); err == nil {
+		t.Error("Loaded a version that fell out of retention")
+		return
+	}
+	if _, ok := store.Get(v1Blocks[0]); ok {
+		t.Error("Blocks of a dropped version were not deleted")
+		return
+	}
+	if v, err := alice.LoadFileVersion("file1", 3); err != nil || string(v) != "v3" {
+		t.Error("Loaded the wrong version contents", string(v), err)
+		return
+	}
+	checkContents(t, alice, "file1", []byte("v5"))
+
+	// restoring shares blocks with the version; editing must not disturb it
+	if err = bob.RestoreVersion("shared", 3); err != nil {
+		t.Error("Failed to restore version", err)
+		return
+	}
+	bob.AppendFile("shared", []byte(" and more"))
+	bob.WriteAt("shared", []byte("V"), 0)
+	checkContents(t, alice, "file1", []byte("V3 and more"))
+	if v, err := alice.LoadFileVersion("file1", 3); err != nil || string(v) != "v3" {
+		t.Error("Editing restored contents changed the version", string(v), err)
+		return
+	}
+	if v, err := alice.LoadFileVersion("file1", 5); err != nil || string(v) != "v5" {
+		t.Error("Restoring did not keep the replaced contents", string(v), err)
+		return
+	}
+
+	// versions survive re-keying on revocation
+	if err = alice.RevokeFile("file1", "bob"); err != nil {
+		t.Error("Could not revoke access to versioned file", err)
+		return
+	}
+	if _, err = bob.LoadFileVersion("shared", 3); err == nil {
+		t.Error("Revoked user can still load versions")
+		return
+	}
+	if v, err := alice.LoadFileVersion("file1", 3); err != nil || string(v) != "v3" {
+		t.Error("Version was lost on revocation", string(v), err)
+		return
+	}
+
+	// dropping retention to zero deletes every kept version
+	keys, _ := store.List()
+	before := len(keys)
+	if err = alice.SetVersionRetention("file1", 0); err != nil {
+		t.Error("Failed to drop version retention", err)
+		return
+	}
+	keys, _ = store.List()
+	if versions, _ = alice.ListVersions("file1"); len(versions) != 0 || len(keys) != before-3 {
+		t.Error("Versions were not dropped", versions, before, len(keys))
+		return
+	}
+	checkContents(t, alice, "file1", []byte("V3 and more"))
+}
@@ -0,0 +1,172 @@
+package proj2
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/cs161-staff/userlib"
+	"github.com/google/uuid"
+)
+
+// ***************************************** IN-PLACE EDITS ****************************** //
+
+// Posts data as Text blocks of at most DefaultBlockSize under the file's keys
+// and returns their UUIDs and lengths in order
+func postBlocks(usr User, metadata Metadata, data []byte) (textList []uuid.UUID, lengths []int, err error) {
+	var text Text
+	var chunk int
+
+	for len(data) > 0 {
+		chunk = len(data)
+		if chunk > DefaultBlockSize {
+			chunk = DefaultBlockSize
+		}
+		text.TextUUID = uuid.New()
+		text.Data = data[:chunk]
+		err = postText(usr, text, metadata)
+		if err != nil {
+			return nil, nil, err
+		}
+		textList = append(textList, text.TextUUID)
+		lengths = append(lengths, chunk)
+		data = data[chunk:]
+	}
+	return textList, lengths, nil
+}
+
+// Replaces the bytes [off, off+delLen) of a file with ins, where edit
+// computes off, delLen and ins from the current file size.
+//
+// Only the Text blocks overlapping the edited range are fetched; they are
+// merged together with the new data and re-cut into blocks of at most
+// DefaultBlockSize. Metadata is re-signed once, after which the superseded
+// blocks are deleted.
+func (usr *User) spliceFile(filename string, edit func(size int64) (off int64, delLen int64, ins []byte, err error)) (err error) {
+	// variable declarations
+	var metadata Metadata
+	var text Text
+	var filenameHash string
+	var raw, metadataKey, old, region []byte
+	var lengths, newLengths []int
+	var newList, superseded []uuid.UUID
+	var size, off, delLen, regionStart, pos int64
+	var i0, i1 int
+
+	// verify that this user has access to the given file
+	usr, err = refreshUser(usr)
+	if err != nil {
+		userlib.DebugMsg("Could not update User struct!")
+		return err
+	}
+	filenameHash = getFilenameHash(filename, usr.Username)
+
+	// start over on the current metadata if another writer changes the file first
+	return retryOnConflict(func() (err error) {
+		old, superseded, size, pos = nil, nil, 0, 0
+		metadata, metadataKey, raw, err = verifyFileAccessRaw(*usr, filenameHash)
+		if err != nil {
+			userlib.DebugMsg("could not verify that " + usr.Username + " has access to " + filename)
+			return errors.New(strings.ToTitle("could not verify that user has access to file"))
+		}
+		lengths, err = blockLengths(*usr, metadata)
+		if err != nil {
+			return err
+		}
+		for _, l := range lengths {
+			size += int64(l)
+		}
+
+		off, delLen, region, err = edit(size)
+		if err != nil {
+			return err
+		}
+		if off < 0 || delLen < 0 || off+delLen > size {
+			return errors.New(strings.ToTitle("edit is out of range"))
+		}
+		if delLen == 0 && len(region) == 0 {
+			return nil
+		}
+
+		// blocks [i0, i1) are the ones that overlap the edited range
+		i0 = len(lengths)
+		regionStart = size
+		for i := range lengths {
+			if pos+int64(lengths[i]) > off {
+				i0, regionStart = i, pos
+				break
+			}
+			pos += int64(lengths[i])
+		}
+		i1 = i0
+		for pos = regionStart; i1 < len(lengths) && pos < off+delLen; i1++ {
+			pos += int64(lengths[i1])
+		}
+
+		// fetch the overlapping blocks and splice the new data into them
+		for i := i0; i < i1; i++ {
+			text, err = getText(*usr, metadata, metadata.TextList[i])
+			if err != nil {
+				return err
+			}
+			if len(text.Data) != lengths[i] {
+				userlib.DebugMsg("text block length does not match file metadata")
+				return errors.New(strings.ToTitle("text block length does not match file metadata"))
+			}
+			old = append(old, text.Data...)
+		}
+		region = append(append(append([]byte(nil), old[:off-regionStart]...), region...), old[off+delLen-regionStart:]...)
+
+		// post the rewritten region and swap it in for the old blocks
+		newList, newLengths, err = postBlocks(*usr, metadata, region)
+		if err != nil {
+			return err
+		}
+		superseded = append(superseded, metadata.TextList[i0:i1]...)
+		metadata.TextList = append(append(append([]uuid.UUID(nil), metadata.TextList[:i0]...), newList...), metadata.TextList[i1:]...)
+		metadata.TextLengths = append(append(append([]int(nil), lengths[:i0]...), newLengths...), lengths[i1:]...)
+		metadata.LastModified = usr.Username
+		markModified(&metadata)
+		err = postMetadataCAS(*usr, &metadata, metadataKey, raw)
+		if err != nil {
+			userlib.DebugMsg("error posting file metadata")
+			deleteText(*usr, newList)
+			return err
+		}
+		return releaseText(*usr, metadata, superseded)
+	})
+}
+
+// Writes data into the file starting at byte offset off, overwriting what
+// is there and growing the file if the write runs past its end. Writing
+// beyond the end of the file fills the gap with zero bytes. Only the Text
+// blocks that overlap the write are rewritten.
+func (usr *User) WriteAt(filename string, data []byte, off int64) (err error) {
+	if off < 0 {
+		return errors.New(strings.ToTitle("negative offset"))
+	}
+	return usr.spliceFile(filename, func(size int64) (int64, int64, []byte, error) {
+		if off > size {
+			return size, 0, append(make([]byte, off-size), data...), nil
+		}
+		delLen := size - off
+		if delLen > int64(len(data)) {
+			delLen = int64(len(data))
+		}
+		return off, delLen, data, nil
+	})
+}
+
+// Changes the size of the file to size bytes, dropping data past the new
+// end or padding the file with zero bytes. Only the Text block containing
+// the new end is rewritten; blocks wholly past it are deleted.
+func (usr *User) Truncate(filename string, size int64) (err error) {
+	if size < 0 {
+		return errors.New(strings.ToTitle("negative size"))
+	}
+	return usr.spliceFile(filename, func(cur int64) (int64, int64, []byte, error) {
+		if size < cur {
+			return size, cur - size, nil, nil
+		}
+		return cur, 0, make([]byte, size-cur), nil
+	})
+}
@@ -0,0 +1,115 @@
+package proj2
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Loads a file and compares it against expected, also checking that Metadata's block lengths add up
+func checkContents(t *testing.T, u *User, filename string, expected []byte) bool {
+	v, err := u.LoadFile(filename)
+	if err != nil || !bytes.Equal(v, expected) {
+		t.Errorf("File contents are %q, expected %q (%v)", v, expected, err)
+		return false
+	}
+	u, _ = GetUserWithBackend(u.backend, u.Username, u.password)
+	metadata, _, _ := verifyFileAccess(*u, getFilenameHash(filename, u.Username))
+	total := 0
+	for _, l := range metadata.TextLengths {
+		total += l
+	}
+	if len(metadata.TextLengths) != len(metadata.TextList) || total != len(expected) {
+		t.Error("Metadata block lengths do not match file contents", metadata.TextLengths)
+		return false
+	}
+	return true
+}
+
+func TestWriteAt(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	bob, _ := InitUser("bob", "bar")
+	alice.StoreFile("file1", []byte("0123456789"))
+	alice.AppendFile("file1", []byte("abcdefghij"))
+	alice.AppendFile("file1", []byte("ABCDEFGHIJ"))
+	magic, _ := alice.ShareFile("file1", "bob")
+	bob.ReceiveFile("shared", "alice", magic)
+
+	// overwrite across a block boundary
+	if err := bob.WriteAt("shared", []byte("XYZ"), 8); err != nil {
+		t.Error("Failed to write at offset", err)
+		return
+	}
+	if !checkContents(t, alice, "file1", []byte("01234567XYZbcdefghijABCDEFGHIJ")) {
+		return
+	}
+
+	// the untouched last block was not rewritten
+	alice, _ = GetUser("alice", "foo")
+	before, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	alice.WriteAt("file1", []byte("--"), 0)
+	after, _, _ := verifyFileAccess(*alice, getFilenameHash("file1", "alice"))
+	if after.TextList[len(after.TextList)-1] != before.TextList[len(before.TextList)-1] {
+		t.Error("WriteAt rewrote a block outside the written range")
+		return
+	}
+	if !checkContents(t, alice, "file1", []byte("--234567XYZbcdefghijABCDEFGHIJ")) {
+		return
+	}
+
+	// writes that run past the end grow the file, gaps are zero-filled
+	alice.WriteAt("file1", []byte("END"), 29)
+	if !checkContents(t, alice, "file1", []byte("--234567XYZbcdefghijABCDEFGHIEND")) {
+		return
+	}
+	alice.WriteAt("file1", []byte("!"), 34)
+	if !checkContents(t, alice, "file1", []byte("--234567XYZbcdefghijABCDEFGHIEND\x00\x00!")) {
+		return
+	}
+	if err := alice.WriteAt("file1", []byte("x"), -1); err == nil {
+		t.Error("Wrote at a negative offset")
+		return
+	}
+	if err := alice.WriteAt("nonexistent", []byte("x"), 0); err == nil {
+		t.Error("Wrote to a nonexistent file")
+		return
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	clear()
+
+	alice, _ := InitUser("alice", "foo")
+	alice.StoreFile("file1", []byte("0123456789"))
+	alice.AppendFile("file1", []byte("abcdefghij"))
+	alice.AppendFile("file1", []byte("ABCDEFGHIJ"))
+
+	if err := alice.Truncate("file1", 15); err != nil {
+		t.Error("Failed to truncate", err)
+		return
+	}
+	if !checkContents(t, alice, "file1", []byte("0123456789abcde")) {
+		return
+	}
+	alice.Truncate("file1", 10)
+	if !checkContents(t, alice, "file1", []byte("0123456789")) {
+		return
+	}
+	alice.Truncate("file1", 12)
+	if !checkContents(t, alice, "file1", []byte("0123456789\x00\x00")) {
+		return
+	}
+	alice.Truncate("file1", 0)
+	if !checkContents(t, alice, "file1", nil) {
+		return
+	}
+	alice.AppendFile("file1", []byte("fresh start"))
+	if !checkContents(t, alice, "file1", []byte("fresh start")) {
+		return
+	}
+	if err := alice.Truncate("file1", -1); err == nil {
+		t.Error("Truncated to a negative size")
+		return
+	}
+}